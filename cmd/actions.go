@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Store shell command to run and the name to display when running it
+type action struct {
+	msg          string
+	command      string
+	env          map[string]string
+	dir          string
+	shell        string
+	sudo         bool
+	when         string
+	unless       string
+	ignoreErrors bool
+	fn           func() error
+	pkg          string // package the action checks was installed, so failures can be summed up
+}
+
+// Check the action's when/unless conditions to see if it should run
+func (a action) shouldRun() (bool, error) {
+	when, err := evalCondition(a.when)
+	if err != nil || !when {
+		return false, err
+	}
+	if strings.TrimSpace(a.unless) == "" {
+		return true, nil
+	}
+	unless, err := evalCondition(a.unless)
+	return !unless, err
+}
+
+// Run the action's command (or function), returning its output in the error if it fails
+func (a action) execute() error {
+	if a.fn != nil {
+		return a.fn()
+	}
+
+	shell := a.shell
+	if shell == "" {
+		shell = "sh"
+	}
+
+	// Sort environment variables so the command line is stable
+	var env []string
+	for k, v := range a.env {
+		env = append(env, k+"="+os.ExpandEnv(v))
+	}
+	sort.Strings(env)
+
+	// sudo resets the environment, so pass variables through env(1) instead
+	var cmd *exec.Cmd
+	if a.sudo && os.Geteuid() != 0 {
+		args := append(append([]string{"env"}, env...), shell, "-c", a.command)
+		cmd = exec.Command("sudo", args...)
+	} else {
+		cmd = exec.Command(shell, "-c", a.command)
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Dir = a.dir
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w\n%s", a.command, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Identify an action for deduplication by what it runs and how. Actions that run Go code, or
+// nothing at all, can't be told apart like this, so they have no key and are always kept
+func (a action) key() string {
+	if a.fn != nil || a.command == "" {
+		return ""
+	}
+	var env []string
+	for k, v := range a.env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return fmt.Sprintf("%q %q %q %q %t %q %q", a.command, env, a.dir, a.shell, a.sudo, a.when, a.unless)
+}
+
+// Check if any action needs sudo credentials
+func needsSudo(actions []action) bool {
+	if os.Geteuid() == 0 {
+		return false
+	}
+	for _, a := range actions {
+		if a.sudo {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert an install step from config.toml into an action, expanding ~ in its working directory
+func (s Step) action(home string) action {
+	return action{
+		msg:          s.Msg,
+		command:      s.Cmd,
+		env:          s.Env,
+		dir:          expandPath(s.Cwd, home),
+		shell:        s.Shell,
+		sudo:         s.Sudo,
+		when:         s.When,
+		unless:       s.Unless,
+		ignoreErrors: s.IgnoreErrors,
+	}
+}
+
+// Convert hook steps into actions
+func stepActions(steps []Step, home string) []action {
+	var actions []action
+	for _, s := range steps {
+		actions = append(actions, s.action(home))
+	}
+	return actions
+}
+
+// Wrap a run's actions with the global before_run and after_run hooks
+func withRunHooks(actions []action) []action {
+	home := expandHome("~")
+	actions = append(stepActions(Config.BeforeRun, home), actions...)
+	return append(actions, stepActions(Config.AfterRun, home)...)
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Replace the home directory at the start of path with ~
+func tildePath(path, home string) string {
+	if path == home || strings.HasPrefix(path, home+"/") {
+		return "~" + strings.TrimPrefix(path, home)
+	}
+	return path
+}
+
+// Move a file, copying it if it's on a different filesystem
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Start managing a local dotfile: move it into the cloned repo, add it to config.toml, and
+// symlink it back into place. Encrypted files are left in place, with ciphertext in the repo
+func addTarget(path, class, name, description, repoPath string, encrypt bool) (Target, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return Target{}, err
+	}
+	repoDir := Config.repoDir(home)
+
+	// Only plain files can be added
+	path, err = filepath.Abs(expandPath(path, home))
+	if err != nil {
+		return Target{}, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return Target{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return Target{}, fmt.Errorf("%s isn't a regular file", path)
+	}
+
+	// Derive the repo path from the class and file name, without any leading dot
+	if repoPath == "" {
+		repoPath = class + "/" + strings.TrimPrefix(filepath.Base(path), ".")
+	}
+	t := Target{Description: description, RepoPath: repoPath, LocalPath: tildePath(path, home), Encrypted: encrypt}
+
+	// Check the file isn't managed already, going by the cloned repo's config
+	text, c, err := readRepoConfig(repoDir)
+	if err != nil {
+		return t, fmt.Errorf("reading config.toml from %s: %w", repoDir, err)
+	}
+	for _, s := range c.Sync {
+		for _, existing := range s.Targets {
+			if existing.RepoPath == t.RepoPath || expandPath(existing.localPath(), home) == path {
+				return t, fmt.Errorf("%s is already managed as %s", existing.localPath(), existing.RepoPath)
+			}
+		}
+	}
+	repoFile := repoDir + "/" + t.RepoPath
+	if _, err := os.Lstat(repoFile); err == nil {
+		return t, fmt.Errorf("%s already exists", repoFile)
+	}
+	if name == "" {
+		name = class
+		if s, ok := c.Sync[class]; ok {
+			name = s.Name
+		}
+	}
+
+	// Encrypt the file into the repo, or move it there and link it back, then record it in config.toml
+	if encrypt {
+		if err := addEncrypted(t, path, repoFile, home); err != nil {
+			return t, err
+		}
+	} else {
+		if err := moveFile(path, repoFile); err != nil {
+			return t, err
+		}
+		if err := os.Symlink(repoFile, path); err != nil {
+			return t, err
+		}
+	}
+	text = addTargetToConfig(text, class, name, t)
+	return t, os.WriteFile(repoDir+"/config.toml", []byte(text), 0644)
+}
+
+// Put an encrypted copy of a local file in the repo, keeping the file as the saved copy of it
+func addEncrypted(t Target, path, repoFile, home string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	encrypted, err := encryptContent(content)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(repoFile), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(repoFile, encrypted, 0644); err != nil {
+		return err
+	}
+	if err := writeBase(path, content); err != nil {
+		return err
+	}
+	return applyPermissions(t, path, home)
+}
+
+// Cobra add command — starts managing an existing local dotfile
+var addCmd = &cobra.Command{
+	Use:   "add <path>",
+	Short: "Move a local dotfile into the repo and manage it",
+	Long: "Move a local dotfile into the cloned repo, add it as a sync target in config.toml " +
+		"(keeping comments and formatting), and replace it with a symlink to the repo copy. With " +
+		"--encrypt, an age encrypted copy goes in the repo instead and the file stays where it is.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := map[string]string{}
+		for _, f := range []string{"class", "name", "description", "repo-path"} {
+			v, err := cmd.Flags().GetString(f)
+			if err != nil {
+				log.Fatal(err)
+			}
+			flags[f] = v
+		}
+		if flags["class"] == "" {
+			log.Fatal("--class is required")
+		}
+		if !bareKey.MatchString(flags["class"]) {
+			log.Fatalf("Invalid class %q: use letters, digits, - and _", flags["class"])
+		}
+
+		t, err := addTarget(args[0], flags["class"], flags["name"], flags["description"], flags["repo-path"], flagPresent(cmd, "encrypt"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s Added %s as %s in [sync.%s]\n", checkMark, t.LocalPath, t.RepoPath, flags["class"])
+	},
+}
+
+func init() {
+	addCmd.Flags().StringP("class", "c", "", "Sync class to add the file to (e.g. tmux)")
+	addCmd.Flags().StringP("name", "", "", "Display name, if the class is new")
+	addCmd.Flags().StringP("description", "d", "", "Description of the file")
+	addCmd.Flags().StringP("repo-path", "", "", "Path in the repo (defaults to <class>/<file name>)")
+	addCmd.Flags().BoolP("encrypt", "e", false, "Keep the file in the repo encrypted with age")
+	rootCmd.AddCommand(addCmd)
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Targets with strategy = "block" don't own their local file. Their repo content goes in a block
+// inside it, between marker comments, so the rest of the file is left alone:
+//
+//	# BEGIN shell-config ssh/config
+//	...
+//	# END shell-config ssh/config
+
+// Get the marker lines around a target's block, named after its repo path
+func (t Target) blockMarkers() (string, string) {
+	comment := t.Comment
+	if comment == "" {
+		comment = "#"
+	}
+	return comment + " BEGIN shell-config " + t.RepoPath, comment + " END shell-config " + t.RepoPath
+}
+
+// Split text into lines, without an empty line for a trailing newline
+func splitLines(text []byte) []string {
+	if len(text) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(text), "\n"), "\n")
+}
+
+// Join lines into text with a trailing newline
+func joinLines(lines []string) []byte {
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// Find the indices of a block's marker lines
+func findBlock(lines []string, begin, end string) (int, int, bool) {
+	for i, line := range lines {
+		if strings.TrimSpace(line) != begin {
+			continue
+		}
+		for j := i + 1; j < len(lines); j++ {
+			if strings.TrimSpace(lines[j]) == end {
+				return i, j, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Get the content of a target's block in text
+func (t Target) extractBlock(text []byte) ([]byte, bool) {
+	begin, end := t.blockMarkers()
+	lines := splitLines(text)
+	i, j, ok := findBlock(lines, begin, end)
+	if !ok {
+		return nil, false
+	}
+	return joinLines(lines[i+1 : j]), true
+}
+
+// Put content in a target's block in text, replacing the block if it's there or adding it to the
+// end otherwise
+func (t Target) insertBlock(text, content []byte) []byte {
+	begin, end := t.blockMarkers()
+	lines := splitLines(text)
+	block := append(append([]string{begin}, splitLines(content)...), end)
+
+	if i, j, ok := findBlock(lines, begin, end); ok {
+		return joinLines(append(lines[:i], append(block, lines[j+1:]...)...))
+	}
+	if len(lines) > 0 && lines[len(lines)-1] != "" {
+		lines = append(lines, "")
+	}
+	return joinLines(append(lines, block...))
+}
+
+// Take a target's block out of text, along with the blank line added before it
+func (t Target) removeBlock(text []byte) ([]byte, bool) {
+	begin, end := t.blockMarkers()
+	lines := splitLines(text)
+	i, j, ok := findBlock(lines, begin, end)
+	if !ok {
+		return text, false
+	}
+	if i > 0 && lines[i-1] == "" && (j+1 == len(lines) || lines[j+1] == "") {
+		i--
+	}
+	return joinLines(append(lines[:i], lines[j+1:]...)), true
+}
+
+// Write a file, keeping its mode if it exists
+func writeKeepingMode(path string, content []byte, mode, dirMode os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), dirMode); err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, mode)
+}
+
+// Put a target's repo content in its block in the local file, running hooks only if the file changes
+func blockTarget(t Target, localPath string, content []byte, home string) error {
+	existing, err := os.ReadFile(localPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	updated := t.insertBlock(existing, content)
+	if bytes.Equal(existing, updated) {
+		return nil
+	}
+
+	if err := t.runHooks(t.Pre, home); err != nil {
+		return err
+	}
+	if err := writeKeepingMode(localPath, updated, 0644, 0755); err != nil {
+		return err
+	}
+	return t.runHooks(t.Post, home)
+}
+
+// Take a target's block out of its local file, running hooks if it was there
+func unblockTarget(t Target, localPath, home string) (bool, error) {
+	existing, err := os.ReadFile(localPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	updated, found := t.removeBlock(existing)
+	if !found {
+		return false, nil
+	}
+
+	if err := t.runHooks(t.Pre, home); err != nil {
+		return false, err
+	}
+	if err := writeKeepingMode(localPath, updated, 0644, 0755); err != nil {
+		return false, err
+	}
+	return true, t.runHooks(t.Post, home)
+}
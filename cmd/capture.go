@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aymanbagabas/go-udiff"
+	"github.com/spf13/cobra"
+)
+
+// Returned when capturing a target rendered from a template, which can't be copied back
+var errTemplateCapture = errors.New("rendered from a template, so edit it in the repo instead")
+
+// Copy a target's local file back into the cloned repo, returning the diff of what changed
+func captureTarget(t Target, home string, dryRun bool) (string, error) {
+	localPath := expandPath(t.LocalPath, home)
+	repoFile := Config.repoDir(home) + "/" + t.RepoPath
+
+	// Linked targets already edit the repo directly
+	if linkedToRepo(localPath, repoFile) || sameFile(localPath, repoFile) {
+		return "", nil
+	}
+	if t.strategy("", false) == strategyTemplate {
+		return "", errTemplateCapture
+	}
+
+	localContent, err := os.ReadFile(localPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	// Only the block belongs to the repo
+	if t.strategy("", false) == strategyBlock {
+		var found bool
+		if localContent, found = t.extractBlock(localContent); !found {
+			return "", nil
+		}
+	}
+	repoContent, err := os.ReadFile(repoFile)
+	if err == nil {
+		repoContent, err = t.plainContent(repoContent)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if bytes.Equal(localContent, repoContent) {
+		return "", nil
+	}
+
+	diff := udiff.Unified(t.RepoPath, t.LocalPath, string(repoContent), string(localContent))
+	if dryRun {
+		return diff, nil
+	}
+
+	// Encrypt again (age ciphertext is different every time, so only changed targets are rewritten)
+	if t.Encrypted {
+		if localContent, err = encryptContent(localContent); err != nil {
+			return "", err
+		}
+	}
+
+	// Keep the repo file's mode if it already exists
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(repoFile); err == nil {
+		mode = info.Mode().Perm()
+	}
+	return diff, os.WriteFile(repoFile, localContent, mode)
+}
+
+// Cobra capture command — copies locally modified dotfiles back into the cloned repo
+var captureCmd = &cobra.Command{
+	Use:   "capture [target...]",
+	Short: "Copy locally modified dotfiles back into the cloned repo",
+	Long: "Copy locally modified dotfiles back to their repo_path in the cloned repo, showing what " +
+		"changed. Targets can be given by class (e.g. tmux), repo path or local path, and default " +
+		"to every target.",
+	Run: func(cmd *cobra.Command, args []string) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		repoDir := Config.repoDir(home)
+		if _, err := os.Stat(repoDir + "/.git"); err != nil {
+			log.Fatalf("No clone of the repo at %s, run a full install first", repoDir)
+		}
+		targets, err := selectTargets(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dryRun := flagPresent(cmd, "dry-run")
+
+		// Copy each modified target into the repo, showing the diff
+		var captured []Target
+		for _, t := range targets {
+			diff, err := captureTarget(t, home, dryRun)
+			if errors.Is(err, errTemplateCapture) {
+				fmt.Printf("%s %s is %s\n", skipMark, t.LocalPath, err)
+				continue
+			} else if err != nil {
+				log.Fatal(err)
+			}
+			if diff != "" {
+				fmt.Print(colorDiff(diff))
+				captured = append(captured, t)
+			}
+		}
+		if len(captured) == 0 {
+			fmt.Println("No local changes to capture")
+			return
+		}
+		if dryRun || !flagPresent(cmd, "commit") {
+			return
+		}
+
+		// Commit the captured files, generating a message if none was given
+		message, err := cmd.Flags().GetString("message")
+		if err != nil {
+			log.Fatal(err)
+		}
+		var paths, names []string
+		for _, t := range captured {
+			paths = append(paths, t.RepoPath)
+			names = append(names, t.LocalPath)
+		}
+		if message == "" {
+			message = "Capture local changes to " + strings.Join(names, ", ")
+		}
+		if _, err := git(repoDir, append([]string{"add", "--"}, paths...)...); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := git(repoDir, append([]string{"commit", "-m", message, "--"}, paths...)...); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Committed %d file(s) in %s\n", len(paths), repoDir)
+	},
+}
+
+func init() {
+	captureCmd.Flags().BoolP("commit", "", false, "Commit the captured files")
+	captureCmd.Flags().StringP("message", "m", "", "Commit message (generated if not given)")
+	captureCmd.Flags().BoolP("dry-run", "n", false, "Show what would be captured without changing anything")
+	rootCmd.AddCommand(captureCmd)
+}
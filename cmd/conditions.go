@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+// Condition expressions are used by the `when` and `unless` keys of install actions, e.g.
+//
+//	when = 'command_exists("vim") && os != "darwin"'
+//
+// They support string literals, true/false, the variables below, the functions below, the
+// operators ==, !=, !, && and ||, and parentheses.
+
+// Variables available to condition expressions
+var conditionVariables = map[string]func() interface{}{
+	"os":   func() interface{} { return runtime.GOOS },
+	"arch": func() interface{} { return runtime.GOARCH },
+	"user": func() interface{} {
+		if u, err := user.Current(); err == nil {
+			return u.Username
+		}
+		return os.Getenv("USER")
+	},
+	"hostname": func() interface{} {
+		hostname, _ := os.Hostname()
+		return hostname
+	},
+}
+
+// Functions available to condition expressions, all of which take a single string argument
+var conditionFunctions = map[string]func(string) interface{}{
+	"command_exists": func(s string) interface{} { return commandExists(s) },
+	"file_exists": func(s string) interface{} {
+		_, err := os.Stat(expandHome(s))
+		return err == nil
+	},
+	"env": func(s string) interface{} { return os.Getenv(s) },
+}
+
+// A parsed condition, evaluated lazily so checks reflect the system at run time
+type condition func() interface{}
+
+// Parser state for a condition expression
+type conditionParser struct {
+	tokens []string
+	pos    int
+}
+
+// Split a condition expression into tokens
+func tokenizeCondition(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			// Read string literal, keeping the quotes so it can be told apart from identifiers
+			j := i + 1
+			for j < len(expr) && expr[j] != '"' {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string in %q", expr)
+			}
+			tokens = append(tokens, expr[i:j+1])
+			i = j + 1
+		case strings.HasPrefix(expr[i:], "=="), strings.HasPrefix(expr[i:], "!="),
+			strings.HasPrefix(expr[i:], "&&"), strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case strings.ContainsRune("!(),", c):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(expr) && (expr[j] == '_' || unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j]))) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q in %q", c, expr)
+		}
+	}
+	return tokens, nil
+}
+
+// Look at the next token without consuming it
+func (p *conditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// Consume the next token
+func (p *conditionParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// Parse `a || b`
+func (p *conditionParser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func() interface{} { return truthy(l()) || truthy(right()) }
+	}
+	return left, nil
+}
+
+// Parse `a && b`
+func (p *conditionParser) parseAnd() (condition, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func() interface{} { return truthy(l()) && truthy(right()) }
+	}
+	return left, nil
+}
+
+// Parse `!a`
+func (p *conditionParser) parseUnary() (condition, error) {
+	if p.peek() == "!" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func() interface{} { return !truthy(operand()) }, nil
+	}
+	return p.parseComparison()
+}
+
+// Parse `a == b` and `a != b`
+func (p *conditionParser) parseComparison() (condition, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.peek(); op == "==" || op == "!=" {
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return func() interface{} {
+			equal := fmt.Sprint(left()) == fmt.Sprint(right())
+			return equal == (op == "==")
+		}, nil
+	}
+	return left, nil
+}
+
+// Parse literals, variables, function calls and parenthesised expressions
+func (p *conditionParser) parsePrimary() (condition, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case t == "(":
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return inner, nil
+	case strings.HasPrefix(t, `"`):
+		s := strings.ReplaceAll(strings.ReplaceAll(t[1:len(t)-1], `\"`, `"`), `\\`, `\`)
+		return func() interface{} { return s }, nil
+	case t == "true" || t == "false":
+		b := t == "true"
+		return func() interface{} { return b }, nil
+	case p.peek() == "(":
+		fn, ok := conditionFunctions[t]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %q", t)
+		}
+		p.next()
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("%s takes exactly one argument", t)
+		}
+		return func() interface{} { return fn(fmt.Sprint(arg())) }, nil
+	default:
+		variable, ok := conditionVariables[t]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %q", t)
+		}
+		return condition(variable), nil
+	}
+}
+
+// Whether a condition value counts as true
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	return false
+}
+
+// Parse a condition expression
+func parseCondition(expr string) (condition, error) {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := conditionParser{tokens: tokens}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("%s in %q", err, expr)
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in %q", p.peek(), expr)
+	}
+	return c, nil
+}
+
+// Evaluate a condition expression, treating an empty expression as true
+func evalCondition(expr string) (bool, error) {
+	if strings.TrimSpace(expr) == "" {
+		return true, nil
+	}
+	c, err := parseCondition(expr)
+	if err != nil {
+		return false, err
+	}
+	return truthy(c()), nil
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Editing config.toml in the cloned repo is done on the text, rather than by re-encoding the
+// TOML, so comments and formatting are kept as they are.
+
+// Read and parse config.toml from the cloned repo, returning its text too
+func readRepoConfig(repoDir string) (string, config, error) {
+	var c config
+	b, err := os.ReadFile(repoDir + "/config.toml")
+	if err != nil {
+		return "", c, err
+	}
+	_, err = toml.Decode(string(b), &c)
+	return string(b), c, err
+}
+
+// Names that can be used unquoted in TOML table headers, as sync classes are
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Quote a string for TOML
+func tomlString(s string) string {
+	return strconv.Quote(s)
+}
+
+// Format a sync target as a [[sync.<class>.targets]] table
+func formatTarget(class string, t Target) string {
+	text := fmt.Sprintf("[[sync.%s.targets]]\ndescription = %s\nrepo_path = %s\nlocal_path = %s\n",
+		class, tomlString(t.Description), tomlString(t.RepoPath), tomlString(t.LocalPath))
+	if t.Encrypted {
+		text += "encrypted = true\n"
+	}
+	return text
+}
+
+// Check if a line of config.toml is a table header belonging to a sync class
+func inSyncClass(line, class string) bool {
+	return line == "[sync."+class+"]" || strings.HasPrefix(line, "[sync."+class+".") || strings.HasPrefix(line, "[[sync."+class+".")
+}
+
+// Find the line after the last line of content in a section, given the index of its header. The
+// section ends at the next header that doesn't belong to it, not counting the comments and blank
+// lines just above that header, which describe the next section
+func sectionEnd(lines []string, start int, belongs func(string) bool) int {
+	end := len(lines)
+	for i := start + 1; i < len(lines); i++ {
+		if strings.HasPrefix(lines[i], "[") && !belongs(lines[i]) {
+			end = i
+			break
+		}
+	}
+	for end > start+1 {
+		trimmed := strings.TrimSpace(lines[end-1])
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		end--
+	}
+	return end
+}
+
+// Add a sync target to the text of config.toml. It's added after the last target in its class,
+// or in a new class after the last existing class if the class doesn't exist yet
+func addTargetToConfig(text, class, name string, t Target) string {
+	lines := strings.Split(text, "\n")
+
+	// Find the class, and the last line of any sync class
+	classStart, lastSyncStart := -1, -1
+	for i, line := range lines {
+		if line == "[sync."+class+"]" {
+			classStart = i
+		}
+		if strings.HasPrefix(line, "[sync.") || strings.HasPrefix(line, "[[sync.") {
+			lastSyncStart = i
+		}
+	}
+
+	var insert string
+	var at int
+	switch {
+	case classStart >= 0:
+		at = sectionEnd(lines, classStart, func(l string) bool { return inSyncClass(l, class) })
+		insert = "\n" + formatTarget(class, t)
+	case lastSyncStart >= 0:
+		at = sectionEnd(lines, lastSyncStart, func(l string) bool { return strings.HasPrefix(l, "[[sync.") || strings.HasPrefix(l, "[sync.") })
+		insert = fmt.Sprintf("\n# %s config files\n[sync.%s]\nname = %s\n\n%s", name, class, tomlString(name), formatTarget(class, t))
+	default:
+		return strings.TrimRight(text, "\n") + fmt.Sprintf("\n\n[sync.%s]\nname = %s\n\n%s", class, tomlString(name), formatTarget(class, t))
+	}
+
+	// Insert after the last line of content, dropping the new block's trailing newline
+	block := strings.Split(strings.TrimSuffix(insert, "\n"), "\n")
+	lines = append(lines[:at], append(block, lines[at:]...)...)
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Find sync targets that would clash on this system: two going to the same place (or to places
+// that only differ by case, which are the same on case-insensitive file systems like macOS's), one
+// going inside another's file, or one going inside a directory another class folds into a link.
+// Targets are checked at their XDG locations, since this runs every time the config is loaded and
+// checking xdg_requires means running programs
+func (c *config) targetConflicts() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	targets := c.syncTargets(Target.preferredPath)
+	describe := func(t Target) string {
+		return fmt.Sprintf("%s (%s)", t.source(), t.LocalPath)
+	}
+	localPath := func(t Target) string {
+		return filepath.Clean(expandPath(t.LocalPath, home))
+	}
+
+	// Directories that targets in folding classes could be linked as a whole
+	type foldedDir struct {
+		path  string
+		class string
+	}
+	var folded []foldedDir
+	for _, t := range targets {
+		if !c.Sync[t.class].Fold {
+			continue
+		}
+		if _, dir, ok := foldDirs(t.RepoPath, localPath(t)); ok {
+			folded = append(folded, foldedDir{dir, t.class})
+		}
+	}
+
+	var problems []string
+	seen := map[string]bool{}
+	report := func(problem string) {
+		if !seen[problem] {
+			seen[problem] = true
+			problems = append(problems, problem)
+		}
+	}
+	// Blocks are named by repo path, so several can share a file. Config isn't set while it's
+	// loading, so the default strategy comes from c
+	isBlock := func(t Target) bool {
+		return t.Strategy == strategyBlock || (t.Strategy == "" && c.DefaultStrategy == strategyBlock)
+	}
+
+	for i, a := range targets {
+		pathA := localPath(a)
+		for _, b := range targets[i+1:] {
+			pathB := localPath(b)
+			switch {
+			case isBlock(a) && isBlock(b) && strings.EqualFold(pathA, pathB):
+				// Blocks sharing a file
+			case pathA == pathB:
+				report(fmt.Sprintf("%s and %s go to the same place", describe(a), describe(b)))
+			case strings.EqualFold(pathA, pathB):
+				report(fmt.Sprintf("%s and %s only differ by case", describe(a), describe(b)))
+			case within(pathB, pathA):
+				report(fmt.Sprintf("%s goes inside %s, which is a file", describe(b), describe(a)))
+			case within(pathA, pathB):
+				report(fmt.Sprintf("%s goes inside %s, which is a file", describe(a), describe(b)))
+			}
+		}
+		for _, f := range folded {
+			if f.class != a.class && within(pathA, f.path) {
+				report(fmt.Sprintf("%s goes inside %s, which sync.%s folds into a link to the repo", describe(a), tildePath(f.path, home), f.class))
+			}
+		}
+	}
+	return problems
+}
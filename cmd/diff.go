@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aymanbagabas/go-udiff"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/spf13/cobra"
+)
+
+// Styles for diff output
+var (
+	diffHeaderStyle = lipgloss.NewStyle().Bold(true)
+	diffHunkStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("39"))
+	diffAddStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("42"))
+	diffRemoveStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("196"))
+)
+
+// Get a unified diff from a target's local file to its repo version at ref (or the main branch),
+// decrypted and rendered as needed
+func targetDiff(t Target, home, ref string) (string, error) {
+	url := Config.Metadata.BaseURL + t.RepoPath
+	if ref != "" {
+		url = Config.Metadata.rawURL(ref, t.RepoPath)
+	}
+	repoContent, err := fetch(url)
+	if err == nil {
+		repoContent, err = t.repoVersion(repoContent, home)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Treat a missing local file as empty
+	localLabel := t.LocalPath
+	localContent, err := os.ReadFile(expandPath(t.LocalPath, home))
+	if os.IsNotExist(err) {
+		localLabel = "/dev/null"
+	} else if err != nil {
+		return "", err
+	}
+
+	// Blocks only replace part of the file
+	if t.strategy("", false) == strategyBlock {
+		repoContent = t.insertBlock(localContent, repoContent)
+	}
+
+	repoLabel := t.RepoPath
+	if ref != "" {
+		repoLabel += "@" + ref
+	}
+	return udiff.Unified(localLabel, repoLabel, string(localContent), string(repoContent)), nil
+}
+
+// Colour the lines of a unified diff
+func colorDiff(diff string) string {
+	lines := strings.Split(diff, "\n")
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "---") || strings.HasPrefix(line, "+++"):
+			lines[i] = diffHeaderStyle.Render(line)
+		case strings.HasPrefix(line, "@@"):
+			lines[i] = diffHunkStyle.Render(line)
+		case strings.HasPrefix(line, "+"):
+			lines[i] = diffAddStyle.Render(line)
+		case strings.HasPrefix(line, "-"):
+			lines[i] = diffRemoveStyle.Render(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Count added and removed lines in a unified diff
+func diffCounts(diff string) (added, removed int) {
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---"):
+		case strings.HasPrefix(line, "+"):
+			added++
+		case strings.HasPrefix(line, "-"):
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// Exit the diff command with an error. Like diff(1), status 1 means differences were found and 2
+// means something went wrong
+func diffFatal(err error) {
+	log.Print(err)
+	os.Exit(2)
+}
+
+// Cobra diff command — shows how local dotfiles differ from the repo, exiting 1 if any do
+var diffCmd = &cobra.Command{
+	Use:   "diff [target...]",
+	Short: "Show differences between local dotfiles and the repo",
+	Long: "Show differences between local dotfiles and the repo. Targets can be given by class " +
+		"(e.g. zsh), repo path or local path, and default to every target. Exits with status 1 if " +
+		"there are differences, or 2 if something went wrong.",
+	Run: func(cmd *cobra.Command, args []string) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			diffFatal(err)
+		}
+		targets, err := selectTargets(args)
+		if err != nil {
+			diffFatal(err)
+		}
+		ref, err := cmd.Flags().GetString("ref")
+		if err != nil {
+			diffFatal(err)
+		}
+		stat := flagPresent(cmd, "stat")
+		noColor := flagPresent(cmd, "no-color")
+
+		// Print diffs (or a summary of them) for each target that differs
+		var changed, totalAdded, totalRemoved int
+		for _, t := range targets {
+			diff, err := targetDiff(t, home, ref)
+			if err != nil {
+				diffFatal(err)
+			}
+			if diff == "" {
+				continue
+			}
+			changed++
+
+			if stat {
+				added, removed := diffCounts(diff)
+				totalAdded += added
+				totalRemoved += removed
+				bar := diffAddStyle.Render(strings.Repeat("+", added)) + diffRemoveStyle.Render(strings.Repeat("-", removed))
+				if noColor {
+					bar = strings.Repeat("+", added) + strings.Repeat("-", removed)
+				}
+				fmt.Printf(" %s | %d %s\n", t.LocalPath, added+removed, bar)
+			} else if noColor {
+				fmt.Print(diff)
+			} else {
+				fmt.Print(colorDiff(diff))
+			}
+		}
+
+		if stat && changed > 0 {
+			fmt.Printf(" %d files changed, %d insertions(+), %d deletions(-)\n", changed, totalAdded, totalRemoved)
+		}
+		if changed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	diffCmd.Flags().StringP("ref", "", "", "Branch, tag or commit to compare with (defaults to main)")
+	diffCmd.Flags().BoolP("stat", "", false, "Only show a summary of changes")
+	diffCmd.Flags().BoolP("no-color", "", false, "Don't colour output")
+	diffCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		diffFatal(err)
+		return nil
+	})
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Remove the temporary install in dir if it has expired: undo it, then remove whatever is left of
+// the directory. Returns the manifest, and whether it was removed
+func gcTmp(dir string, dryRun bool) (tmpManifest, bool, error) {
+	m, err := readManifest(dir)
+	if err != nil || !m.expired() {
+		return m, false, err
+	}
+	if err := uninstallTmp(dir, dryRun); err != nil {
+		return m, false, err
+	}
+	if dryRun {
+		return m, true, nil
+	}
+	return m, true, os.RemoveAll(dir)
+}
+
+// Cobra gc command — removes temporary installs that have expired
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove expired temporary installs",
+	Long: "Remove the temporary install if the --ttl it was installed with has passed, uninstalling " +
+		"the packages it added and deleting " + Config.TmpDir + ". Run it from cron to clean up shared " +
+		"machines automatically.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir := tmpDir()
+		if _, err := os.Stat(filepath.Join(dir, "manifest.json")); os.IsNotExist(err) {
+			fmt.Println("No temporary install to remove")
+			return
+		}
+
+		m, removed, err := gcTmp(dir, flagPresent(cmd, "dry-run"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch {
+		case removed:
+			fmt.Printf("%s Removed temporary install in %s, which expired at %s\n", checkMark, dir, m.Expires.Format(time.DateTime))
+		case m.Expires.IsZero():
+			fmt.Printf("%s Temporary install in %s doesn't expire, remove it with uninstall --tmp\n", skipMark, dir)
+		default:
+			fmt.Printf("%s Temporary install in %s expires at %s\n", skipMark, dir, m.Expires.Format(time.DateTime))
+		}
+	},
+}
+
+func init() {
+	gcCmd.Flags().BoolP("dry-run", "n", false, "Show what would be removed without changing anything")
+	rootCmd.AddCommand(gcCmd)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"path"
+	"strings"
+)
+
+// Match a slash-separated path against a glob pattern. As well as path.Match's *, ? and [...],
+// which never match a /, a ** segment matches any number of whole path segments (including none)
+func globMatch(pattern, name string) (bool, error) {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// Match path segments against pattern segments
+func matchSegments(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try ** against every possible number of segments
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchSegments(pattern[1:], name[i:]); err != nil || ok {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
+
+// Check if a pattern has any wildcards
+func hasGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// Get the directory part of a glob pattern before any wildcards, e.g. vim for vim/**/*.py. For a
+// pattern without wildcards, that's the directory the file it names is in
+func globBase(pattern string) string {
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if hasGlob(segment) {
+			return strings.Join(segments[:i], "/")
+		}
+	}
+	return path.Dir(pattern)
+}
+
+// Check a glob pattern is well formed
+func validGlob(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match a path relative to a directory target against an include or exclude pattern. Patterns
+// without a / match file names at any depth, like in .gitignore
+func matchRelative(pattern, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		rel = path.Base(rel)
+	}
+	ok, _ := globMatch(pattern, rel)
+	return ok
+}
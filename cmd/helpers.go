@@ -2,14 +2,18 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"os/exec"
+	"runtime"
 	"sort"
 	"strings"
 
+	"filippo.io/age"
 	"github.com/BurntSushi/toml"
 	"github.com/google/go-github/github"
 )
@@ -34,22 +38,37 @@ func runCommand(command string) string {
 	return string(stdout)
 }
 
-// Download a file and return as byte array
-func download(url string) []byte {
+// Run a git command in a repo, returning its output in the error if it fails
+func git(dir string, args ...string) (string, error) {
+	output, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w\n%s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// Download a file and return as byte array, failing on non-200 responses
+func fetch(url string) ([]byte, error) {
 	// Get request
 	resp, err := http.Get(url)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
 
 	// Read body
-	b, err := io.ReadAll(resp.Body)
+	return io.ReadAll(resp.Body)
+}
+
+// Download a file and return as byte array
+func download(url string) []byte {
+	b, err := fetch(url)
 	if err != nil {
-		log.Fatalln(err)
+		log.Fatal(err)
 	}
-
-	// Return bytes
 	return b
 }
 
@@ -63,10 +82,26 @@ func contains(s []string, e string) bool {
 	return false
 }
 
-// Get parent directory of path
-func parentDir(path string) string {
-	splitLocalPath := strings.Split(path, "/")
-	return strings.Join(splitLocalPath[:len(splitLocalPath)-1], "/")
+// Replace a leading ~ in path with the given home directory
+func expandPath(path, home string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return home + path[1:]
+	}
+	return path
+}
+
+// Replace a leading ~ in path with the user's home directory
+func expandHome(path string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return expandPath(path, home)
+}
+
+// Quote a string for a shell script, so it's taken literally
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
 
 // Sort an array of strings, irrespective of case
@@ -84,31 +119,72 @@ func Sorted(s []string) []string {
 // Structs to store contents of config.toml
 type (
 	config struct {
-		TmpDir          string `toml:"tmp_dir"`
-		InstallURL      string `toml:"custom_install_url"`
-		HelpDescription string `toml:"help_description"`
-		Sync            map[string]targetClass
-		Installers      map[string]Installer
-		Metadata        metadata
+		TmpDir            string   `toml:"tmp_dir"`
+		InstallURL        string   `toml:"custom_install_url"`
+		HelpDescription   string   `toml:"help_description"`
+		PreferredManagers []string `toml:"preferred_managers"`
+		DefaultStrategy   string   `toml:"default_strategy"`
+		AgeIdentity       string   `toml:"age_identity"`
+		AgeRecipients     []string `toml:"age_recipients"`
+		BeforeRun         []Step   `toml:"before_run"`
+		AfterRun          []Step   `toml:"after_run"`
+		Sync              map[string]targetClass
+		Installers        map[string]Installer
+		Metadata          metadata
 	}
 
 	targetClass struct {
 		Name      string
 		MacOSOnly bool `toml:"macos_only"`
+		Fold      bool
 		Targets   []Target
 	}
 
+	// A file, or a directory mirrored file by file, to keep in sync with the repo
 	Target struct {
+		class       string
+		index       int    // position in its class
+		parent      string // repo path of the directory target a file belongs to
 		Description string
 		RepoPath    string `toml:"repo_path"`
 		LocalPath   string `toml:"local_path"`
+		XDGConfig   string `toml:"xdg_config"`
+		XDGData     string `toml:"xdg_data"`
+		XDGState    string `toml:"xdg_state"`
+		XDGRequires string `toml:"xdg_requires"`
+		Strategy    string
+		Comment     string // comment prefix for block markers
+		Mode        string
+		DirMode     string `toml:"dir_mode"`
+		Owner       string
+		Encrypted   bool // stored in the repo as age ciphertext
+		Include     []string
+		Exclude     []string
+		Prune       bool
+		Pre         []Step
+		Post        []Step
 	}
 
 	Installer struct {
 		HelpMessage string `toml:"help_message"`
 		Description string
-		Install     []map[string]string
-		TmpInstall  []map[string]string `toml:"tmp_install"`
+		Install     []Step
+		TmpInstall  []Step `toml:"tmp_install"`
+		Pre         []Step
+		Post        []Step
+	}
+
+	// A single install action. Cmd is either an @install/@save directive or a shell command
+	Step struct {
+		Msg          string
+		Cmd          string
+		Env          map[string]string
+		Cwd          string
+		Shell        string
+		When         string
+		Unless       string
+		Sudo         bool
+		IgnoreErrors bool `toml:"ignore_errors"`
 	}
 
 	metadata struct {
@@ -119,17 +195,110 @@ type (
 	}
 )
 
-// Create map of repo paths and local paths for all sync targets
-func (c *config) SyncTargets() map[string]string {
-	targets := make(map[string]string)
-	for _, s := range Config.Sync {
-		for _, t := range s.Targets {
-			targets[t.RepoPath] = t.LocalPath
+// Get every sync target, sorted by class, with directories expanded into their files and local
+// paths resolved for this system
+func (c *config) SyncTargets() []Target {
+	return c.syncTargets(Target.localPath)
+}
+
+// Get every sync target like SyncTargets, with local paths worked out by place
+func (c *config) syncTargets(place func(Target) string) []Target {
+	var classes []string
+	for class := range c.Sync {
+		classes = append(classes, class)
+	}
+
+	var targets []Target
+	for _, class := range Sorted(classes) {
+		for n, t := range c.Sync[class].Targets {
+			t.class, t.index = class, n
+			t.LocalPath = place(t)
+			targets = append(targets, t.expandIn(c.Metadata)...)
 		}
 	}
 	return targets
 }
 
+// Get sync targets that apply to this system
+func (c *config) hostTargets() []Target {
+	var targets []Target
+	for _, t := range c.SyncTargets() {
+		if !c.Sync[t.class].MacOSOnly || runtime.GOOS == "darwin" {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// Get directory targets with prune = true that apply to this system, unexpanded
+func (c *config) pruneTargets() []Target {
+	var classes []string
+	for class := range c.Sync {
+		if !c.Sync[class].MacOSOnly || runtime.GOOS == "darwin" {
+			classes = append(classes, class)
+		}
+	}
+
+	var targets []Target
+	for _, class := range Sorted(classes) {
+		for n, t := range c.Sync[class].Targets {
+			if t.Prune && c.Metadata.isDir(t.RepoPath) {
+				t.class, t.index = class, n
+				t.LocalPath = t.localPath()
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets
+}
+
+// Get where a target is defined in config.toml, for messages
+func (t Target) source() string {
+	return fmt.Sprintf("sync.%s.targets[%d]", t.class, t.index)
+}
+
+// Get the path of the local clone of this repo
+func (c *config) repoDir(home string) string {
+	return fmt.Sprintf("%s/.%s", home, c.Metadata.Repo)
+}
+
+// Get the sync target for a repo path, including files in directory targets
+func (c *config) target(repoPath string) (Target, bool) {
+	for class, s := range c.Sync {
+		for _, t := range s.Targets {
+			t.class = class
+			t.LocalPath = t.localPath()
+			if t.RepoPath == repoPath {
+				return t, true
+			}
+			if !strings.HasPrefix(repoPath, t.RepoPath+"/") {
+				continue
+			}
+			for _, f := range t.files() {
+				if f.RepoPath == repoPath {
+					return f, true
+				}
+			}
+		}
+	}
+	return Target{}, false
+}
+
+// Check if a path in the repo is a directory
+func (m metadata) isDir(repoPath string) bool {
+	for _, p := range m.GitPaths {
+		if strings.HasPrefix(p, repoPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the raw GitHub URL for a file at a branch, tag or commit
+func (m metadata) rawURL(ref, path string) string {
+	return fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/%s", m.User, m.Repo, ref, path)
+}
+
 // Get all paths in remote GitHub repo
 func remoteGitPaths(user, repo, branch string) []string {
 	// Get tree from GitHub API
@@ -166,11 +335,19 @@ func getConfig() config {
 	// Read text of TOML file
 	configToml := download(c.Metadata.BaseURL + "config.toml")
 
-	// Unmarshall TOML file
-	_, err := toml.Decode(string(configToml), &c)
+	// Unmarshall TOML file, rejecting any keys that aren't part of the schema
+	md, err := toml.Decode(string(configToml), &c)
 	if err != nil {
 		log.Fatal(err)
 	}
+	var problems []string
+	for _, key := range md.Undecoded() {
+		problems = append(problems, fmt.Sprintf("unknown key %q", key.String()))
+	}
+	problems = append(problems, c.validate()...)
+	if len(problems) > 0 {
+		log.Fatalf("Invalid config.toml:\n  %s", strings.Join(problems, "\n  "))
+	}
 
 	// Update TmpDir with repo info
 	c.TmpDir = strings.ReplaceAll(c.TmpDir, "@repo_name", c.Metadata.Repo)
@@ -180,12 +357,181 @@ func getConfig() config {
 		c.InstallURL = c.Metadata.BaseURL + "install.sh"
 	}
 
-	// Get all paths in remote GitHub repo
+	// Get all paths in remote GitHub repo, then check @save steps have something to save and sync
+	// targets don't clash
 	c.Metadata.GitPaths = remoteGitPaths(c.Metadata.User, c.Metadata.Repo, branch)
+	if problems := append(c.validateSaves(), c.targetConflicts()...); len(problems) > 0 {
+		log.Fatalf("Invalid config.toml:\n  %s", strings.Join(problems, "\n  "))
+	}
 
 	return c
 }
 
+// Check install steps for missing or conflicting keys and invalid conditions
+func (c *config) validate() []string {
+	var problems []string
+	for flag, i := range c.Installers {
+		for name, steps := range map[string][]Step{"install": i.Install, "tmp_install": i.TmpInstall} {
+			for n, s := range steps {
+				where := fmt.Sprintf("installers.%s.%s[%d]", flag, name, n)
+				problems = append(problems, s.validate(where)...)
+			}
+		}
+		problems = append(problems, validateHooks("installers."+flag+".", map[string][]Step{"pre": i.Pre, "post": i.Post})...)
+	}
+	for class, s := range c.Sync {
+		for n, t := range s.Targets {
+			where := fmt.Sprintf("sync.%s.targets[%d]", class, n)
+			problems = append(problems, validateHooks(where+".", map[string][]Step{"pre": t.Pre, "post": t.Post})...)
+			problems = append(problems, t.validateLocation(where)...)
+			if t.Strategy != "" && !contains(strategies, t.Strategy) {
+				problems = append(problems, fmt.Sprintf("%s: unknown strategy %q", where, t.Strategy))
+			}
+			if t.Encrypted && (t.Strategy == strategySymlink || t.Strategy == strategyHardlink) {
+				problems = append(problems, fmt.Sprintf("%s: encrypted targets can't be linked to the repo, since it only has ciphertext", where))
+			}
+			for key, mode := range map[string]string{"mode": t.Mode, "dir_mode": t.DirMode} {
+				if _, err := parseMode(mode); mode != "" && err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %s: %s", where, key, err))
+				}
+			}
+			if name, group, hasGroup := strings.Cut(t.Owner, ":"); t.Owner != "" && (name == "" || hasGroup && group == "") {
+				problems = append(problems, fmt.Sprintf("%s: owner %q should be user or user:group", where, t.Owner))
+			}
+			for _, pattern := range append(append([]string{}, t.Include...), t.Exclude...) {
+				if err := validGlob(pattern); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: invalid pattern %q", where, pattern))
+				}
+			}
+		}
+	}
+	problems = append(problems, validateHooks("", map[string][]Step{"before_run": c.BeforeRun, "after_run": c.AfterRun})...)
+	if c.DefaultStrategy != "" && !contains(strategies, c.DefaultStrategy) {
+		problems = append(problems, fmt.Sprintf("default_strategy: unknown strategy %q", c.DefaultStrategy))
+	}
+	for _, r := range c.AgeRecipients {
+		if _, err := age.ParseRecipients(strings.NewReader(r)); err != nil {
+			problems = append(problems, fmt.Sprintf("age_recipients: invalid recipient %q", r))
+		}
+	}
+	for _, name := range c.PreferredManagers {
+		if _, ok := packageManagerByName(name); !ok {
+			problems = append(problems, fmt.Sprintf("preferred_managers: unknown package manager %q", name))
+		}
+	}
+	return Sorted(problems)
+}
+
+// Check a target says where it goes: local_path, one XDG location, or both with xdg_requires
+func (t Target) validateLocation(where string) []string {
+	var problems []string
+	xdg := 0
+	for _, path := range []string{t.XDGConfig, t.XDGData, t.XDGState} {
+		if path != "" {
+			xdg++
+		}
+	}
+	switch {
+	case xdg == 0 && t.LocalPath == "":
+		problems = append(problems, where+": missing local_path (or xdg_config, xdg_data or xdg_state)")
+	case xdg > 1:
+		problems = append(problems, where+": only one of xdg_config, xdg_data and xdg_state can be set")
+	}
+	if t.XDGRequires != "" {
+		if _, _, err := parseRequirement(t.XDGRequires); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: xdg_requires: %s", where, err))
+		}
+		if xdg == 0 || t.LocalPath == "" {
+			problems = append(problems, where+": xdg_requires needs an XDG location and a local_path to fall back to")
+		}
+	}
+	return problems
+}
+
+// Check every @save pattern matches something in the repo
+func (c *config) validateSaves() []string {
+	var problems []string
+	for flag, i := range c.Installers {
+		for name, steps := range map[string][]Step{"install": i.Install, "tmp_install": i.TmpInstall} {
+			for n, s := range steps {
+				cmd := strings.TrimSpace(s.Cmd)
+				if !strings.HasPrefix(cmd, "@save ") {
+					continue
+				}
+				pattern, _ := parseSave(strings.TrimPrefix(cmd, "@save "))
+				found := false
+				for _, p := range c.Metadata.GitPaths {
+					if ok, _ := globMatch(pattern, p); ok {
+						found = true
+						break
+					}
+				}
+				if !found {
+					problems = append(problems, fmt.Sprintf("installers.%s.%s[%d]: no files in the repo match %q", flag, name, n, pattern))
+				}
+			}
+		}
+	}
+	return Sorted(problems)
+}
+
+// Check hooks, which must be shell commands rather than directives
+func validateHooks(prefix string, hooks map[string][]Step) []string {
+	var problems []string
+	for name, steps := range hooks {
+		for n, s := range steps {
+			w := fmt.Sprintf("%s%s[%d]", prefix, name, n)
+			problems = append(problems, s.validate(w)...)
+			if strings.HasPrefix(strings.TrimSpace(s.Cmd), "@") {
+				problems = append(problems, w+": hooks must be shell commands")
+			}
+		}
+	}
+	return problems
+}
+
+// Check a single install step, prefixing problems with where it's defined
+func (s Step) validate(where string) []string {
+	var problems []string
+	if s.Msg == "" {
+		problems = append(problems, where+": missing msg")
+	}
+	cmd := strings.TrimSpace(s.Cmd)
+	switch {
+	case cmd == "":
+		problems = append(problems, where+": missing cmd")
+	case cmd == "@install" || cmd == "@save":
+		problems = append(problems, fmt.Sprintf("%s: %s needs an argument", where, cmd))
+	case strings.HasPrefix(cmd, "@install ") || strings.HasPrefix(cmd, "@save "):
+		if len(s.Env) > 0 || s.Cwd != "" || s.Shell != "" || s.Sudo {
+			problems = append(problems, where+": env, cwd, shell and sudo only apply to shell commands")
+		}
+		if strings.HasPrefix(cmd, "@save ") {
+			pattern, dest := parseSave(strings.TrimPrefix(cmd, "@save "))
+			if err := validGlob(pattern); err != nil || pattern == "" {
+				problems = append(problems, fmt.Sprintf("%s: invalid @save pattern %q", where, pattern))
+			}
+			if strings.Contains(cmd, "->") && dest == "" {
+				problems = append(problems, where+": @save is missing a destination after ->")
+			}
+		}
+	case strings.HasPrefix(cmd, "@"):
+		problems = append(problems, fmt.Sprintf("%s: unknown directive %q", where, strings.Fields(cmd)[0]))
+	}
+	if strings.ContainsAny(s.Shell, " \t") {
+		problems = append(problems, fmt.Sprintf("%s: shell %q should be a program name or path", where, s.Shell))
+	}
+	for key, expr := range map[string]string{"when": s.When, "unless": s.Unless} {
+		if strings.TrimSpace(expr) == "" {
+			continue
+		}
+		if _, err := parseCondition(expr); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid %s: %s", where, key, err))
+		}
+	}
+	return problems
+}
+
 // Make config data globally available
 var Config config = getConfig()
 
@@ -193,20 +539,13 @@ var Config config = getConfig()
 //    PACKAGE MANAGER    //
 ///////////////////////////
 
-// Store package manager commands and available packages
+// Store the system package manager and available packages
 type (
 	packageManager struct {
-		commands pmCommands
+		managers []PackageManager
 		Packages pkgGroup
 	}
 
-	pmCommands struct {
-		name         string
-		installCmd   string
-		uninstallCmd string
-		updateCmd    string
-	}
-
 	pkgGroup map[string]pkgs
 
 	pkgs struct {
@@ -225,131 +564,272 @@ func (p *pkgGroup) PackageByName(name string) map[string]string {
 	return map[string]string{}
 }
 
-// Get system install command for a given package
-func (pm *packageManager) installCmd(name string) string {
+// How a package gets installed on this system
+type resolvedPackage struct {
+	manager PackageManager // nil if installed with a custom install_command
+	system  string         // the package manager's name for the package
+}
+
+// Pick how to install a package, falling back through available package managers in order until
+// one has a name for it
+func (pm *packageManager) resolve(name string) (resolvedPackage, bool) {
 	// Get package from packages.toml
 	pack := pm.Packages.PackageByName(name)
 
-	// Check if pack has key "install_command" and return it if it does
-	if installCmd, ok := pack["install_command"]; ok {
-		return installCmd
+	// Packages with an install_command don't need a package manager
+	if _, ok := pack["install_command"]; ok {
+		return resolvedPackage{}, true
 	}
 
-	// Check for system package name and return install command if it exists
-	if systemPackageName, ok := pack[pm.commands.name]; ok {
-		return pm.commands.installCmd + " " + systemPackageName
+	for _, m := range pm.managers {
+		if systemPackageName, ok := pack[m.Name()]; ok {
+			return resolvedPackage{m, systemPackageName}, true
+		}
 	}
+	return resolvedPackage{}, false
+}
 
-	// Package not found, return empty string
-	return ""
+// Name of the package manager used for a package, for showing in the plan
+func (r resolvedPackage) via() string {
+	if r.manager == nil {
+		return "install command"
+	}
+	return r.manager.Name()
+}
+
+// Get system install command for a given package
+func (pm *packageManager) installCmd(name string) string {
+	r, ok := pm.resolve(name)
+	if !ok {
+		return ""
+	}
+	if r.manager == nil {
+		return pm.Packages.PackageByName(name)["install_command"]
+	}
+	return r.manager.Install(r.system)
 }
 
 // Get system uninstall command for a given package
 func (pm *packageManager) uninstallCmd(name string) string {
-	// Get package from packages.toml
-	pack := pm.Packages.PackageByName(name)
+	r, ok := pm.resolve(name)
+	if !ok {
+		return ""
+	}
+	if r.manager == nil {
+		return pm.Packages.PackageByName(name)["uninstall_command"]
+	}
+	return r.manager.Uninstall(r.system)
+}
 
-	// Check if pack has key "uninstall_command" and return it if it does
-	if installCmd, ok := pack["uninstall_command"]; ok {
-		return installCmd
+// Get the action to install a package, adding which package manager it uses to msg
+func (pm *packageManager) installAction(name, msg string) action {
+	r, ok := pm.resolve(name)
+	if !ok {
+		return action{msg: fmt.Sprintf("Skipping %s (no package for %s)", name, pm.managerNames())}
 	}
+	return action{msg: fmt.Sprintf("%s (%s)", msg, r.via()), command: pm.installCmd(name)}
+}
 
-	// Check for system package name and return uninstall command if it exists
-	if systemPackageName, ok := pack[pm.commands.name]; ok {
-		return pm.commands.uninstallCmd + " " + systemPackageName
+// List available package managers, for messages
+func (pm *packageManager) managerNames() string {
+	var names []string
+	for _, m := range pm.managers {
+		names = append(names, m.Name())
+	}
+	if len(names) == 0 {
+		return "any package manager"
 	}
+	return strings.Join(names, ", ")
+}
 
-	// Package not found, return empty string
-	return ""
+// Get how deep a package is in its chain of requirements within the given packages, so packages
+// can be installed after the ones they require
+func (pm *packageManager) requirementDepth(name string, packageNames []string, seen []string) int {
+	requires := pm.Packages.PackageByName(name)["requires"]
+	if requires == "" || !contains(packageNames, requires) || contains(seen, requires) {
+		return 0
+	}
+	return pm.requirementDepth(requires, packageNames, append(seen, name)) + 1
 }
 
-// Type for package install actions
-type packageAction struct {
-	a        action
-	requires string
+// Check if a package is installed, and its version if known. Packages with an install_command
+// can set check_command to a shell command that succeeds when they're installed
+func (pm *packageManager) installedVersion(name string) (installed bool, version string) {
+	r, ok := pm.resolve(name)
+	if !ok {
+		return false, ""
+	}
+	if r.manager == nil {
+		check := pm.Packages.PackageByName(name)["check_command"]
+		return check != "" && (action{command: check}).execute() == nil, ""
+	}
+	version = r.manager.Version(r.system)
+	return r.manager.IsInstalled(r.system), version
 }
 
-// Get system install commands for a given package group
-func (pm *packageManager) packageInstallActions(packageGroupName string) []action {
-	// Sort packageNames by name, irrespective of case
-	var packageNames []string
-	for packageName := range pm.Packages[packageGroupName].Packages {
-		packageNames = append(packageNames, packageName)
+// Get install actions for the given packages. Packages are installed in layers, so packages that
+// require others come after them, and each layer installs all packages that use the same package
+// manager with a single command
+func (pm *packageManager) packageInstallActions(packageNames []string) []action {
+	// Sort packages into layers by requirement depth
+	var layers [][]string
+	for _, name := range Sorted(packageNames) {
+		depth := pm.requirementDepth(name, packageNames, nil)
+		for len(layers) <= depth {
+			layers = append(layers, nil)
+		}
+		layers[depth] = append(layers[depth], name)
 	}
 
-	// Add package install commands
-	var packageActions []packageAction
-	for _, packageName := range Sorted(packageNames) {
-		// Ignore description, as it's not a package
-		if packageName != "description" {
-			// Get install command for package and add to actions if it exists
-			installCommand := pm.installCmd(packageName)
-			if installCommand != "" {
-				// Get requirement for package
-				var requires string
-				if r, ok := pm.Packages.PackageByName(packageName)["requires"]; ok {
-					requires = r
-				}
+	var actions []action
+	for _, layer := range layers {
+		// Group packages by package manager, in order of preference
+		batches := map[string][]string{}
+		var skipped []action
+		for _, name := range layer {
+			r, ok := pm.resolve(name)
+			switch {
+			case !ok:
+				// Note packages that can't be installed here
+				skipped = append(skipped, pm.installAction(name, ""))
+			case r.manager == nil:
+				// Packages with their own install command are installed on their own
+				actions = append(actions, pm.installAction(name, "Installing "+name))
+			default:
+				batches[r.manager.Name()] = append(batches[r.manager.Name()], name)
+			}
+		}
+		for _, m := range pm.managers {
+			if names := batches[m.Name()]; len(names) > 0 {
+				actions = append(actions, pm.batchInstallActions(m, names)...)
+			}
+		}
+		actions = append(actions, skipped...)
+	}
 
-				// Add package install action to packageActions
-				a := action{"Installing " + packageName, installCommand}
+	return actions
+}
+
+// Get actions installing several packages with one package manager command, then checking each
+// package was installed. If the batch fails, packages still missing are retried one at a time, so
+// one bad package doesn't stop the rest from installing, and the batch fails (without stopping the
+// run) if any of them do. Each check shows how its package was resolved, and fails the same way if
+// it isn't installed
+func (pm *packageManager) batchInstallActions(m PackageManager, names []string) []action {
+	var systemNames []string
+	for _, name := range names {
+		r, _ := pm.resolve(name)
+		systemNames = append(systemNames, r.system)
+	}
+
+	// Keep the message short for big batches, since each package is listed after
+	listed := strings.Join(names, ", ")
+	if len(names) > 4 {
+		listed = fmt.Sprintf("%s and %d more", strings.Join(names[:3], ", "), len(names)-3)
+	}
 
-				packageActions = append(packageActions, packageAction{a, requires})
+	actions := []action{{
+		msg: fmt.Sprintf("Installing %s (%s)", listed, m.Name()),
+		fn: func() error {
+			err := (action{command: m.Install(systemNames...)}).execute()
+			if err == nil {
+				return nil
 			}
-		}
+			var retryErrs []error
+			for _, s := range systemNames {
+				if !m.IsInstalled(s) {
+					if err := (action{command: m.Install(s)}).execute(); err != nil {
+						retryErrs = append(retryErrs, err)
+					}
+				}
+			}
+			if len(retryErrs) == 0 {
+				return nil
+			}
+			return errors.Join(append([]error{err}, retryErrs...)...)
+		},
+		ignoreErrors: true,
+	}}
+	for i, name := range names {
+		system := systemNames[i]
+		actions = append(actions, action{
+			msg: fmt.Sprintf("Installed %s (%s via %s)", name, system, m.Name()),
+			fn: func() error {
+				if !m.IsInstalled(system) {
+					return fmt.Errorf("%s failed to install with %s", name, m.Name())
+				}
+				return nil
+			},
+			ignoreErrors: true,
+			pkg:          name,
+		})
 	}
+	return actions
+}
 
-	// Add package actions to actions, ensuring packages that require others are installed after their dependencies
+// Get actions to refresh the index of each package manager used by the given packages
+func (pm *packageManager) updateActions(packageNames []string) []action {
 	var actions []action
-	var packagesWithDependencies []action
-	for _, pa := range packageActions {
-		if pa.requires != "" {
-			packagesWithDependencies = append(packagesWithDependencies, pa.a)
-		} else {
-			actions = append(actions, pa.a)
+	var updated []string
+	for _, name := range packageNames {
+		r, ok := pm.resolve(name)
+		if !ok || r.manager == nil || contains(updated, r.manager.Name()) {
+			continue
 		}
+		updated = append(updated, r.manager.Name())
+		actions = append(actions, action{msg: "Updating " + r.manager.Name(), command: r.manager.Update()})
 	}
-
-	// Add packages with dependencies to actions
-	actions = append(actions, packagesWithDependencies...)
-
 	return actions
 }
 
-// Get system pacakge manager commands and listed packages
-func getPackageManager() packageManager {
-	var pm packageManager
+// Get package names in a package group
+func (pm *packageManager) groupPackages(packageGroupName string) []string {
+	var names []string
+	for name := range pm.Packages[packageGroupName].Packages {
+		names = append(names, name)
+	}
+	return Sorted(names)
+}
 
-	// Get package manager commands
-	if commandExists("pacman") {
-		pm.commands = pmCommands{
-			name:         "pacman",
-			installCmd:   "pacman -S --no-confirm",
-			uninstallCmd: "pacman -Rs --no-confirm",
-			updateCmd:    "pacman -Syu",
+// Order package managers found on the system, putting preferred ones first
+func availableManagers(preferred []string) []PackageManager {
+	var managers []PackageManager
+	var names []string
+	for _, name := range preferred {
+		if m, ok := packageManagerByName(name); ok && m.Detect() && !contains(names, name) {
+			managers = append(managers, m)
+			names = append(names, name)
 		}
-	} else if commandExists("dnf") {
-		pm.commands = pmCommands{
-			name:         "dnf",
-			installCmd:   "dnf install -y",
-			uninstallCmd: "dnf remove -y",
-			updateCmd:    "dnf update",
+	}
+	for _, m := range packageManagers {
+		if m.Detect() && !contains(names, m.Name()) {
+			managers = append(managers, m)
+			names = append(names, m.Name())
 		}
-	} else if commandExists("brew") {
-		pm.commands = pmCommands{
-			name:         "brew",
-			installCmd:   "brew install",
-			uninstallCmd: "brew uninstall",
-			updateCmd:    "brew upgrade",
+	}
+	return managers
+}
+
+// Use the given package managers ahead of any others, failing if one isn't available
+func (pm *packageManager) prefer(names []string) {
+	for _, name := range names {
+		m, ok := packageManagerByName(name)
+		if !ok {
+			log.Fatalf("Unknown package manager %q", name)
 		}
-	} else if commandExists("apt") {
-		pm.commands = pmCommands{
-			name:         "apt",
-			installCmd:   "apt install -y",
-			uninstallCmd: "apt remove -y",
-			updateCmd:    "apt update",
+		if !m.Detect() {
+			log.Fatalf("Package manager %q isn't available on this system", name)
 		}
 	}
+	pm.managers = availableManagers(names)
+}
+
+// Get the available package managers and listed packages
+func getPackageManager() packageManager {
+	var pm packageManager
+
+	// Order package managers by preference, then detection order
+	pm.managers = availableManagers(Config.PreferredManagers)
 
 	// Download packages TOML file from this repo
 	tomlText := download(Config.Metadata.BaseURL + "packages.toml")
@@ -4,12 +4,139 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"regexp"
 	"runtime"
-	"sort"
 	"strings"
 )
 
+// A repo file matched by @save, where to save it, and how
+type savedFile struct {
+	target    Target
+	localPath string
+	strategy  string
+	before    []byte // content of the local file when planned
+}
+
+// What placing a target with each strategy is called in messages
+var strategyVerbs = map[string]string{
+	strategySymlink:  "Linking",
+	strategyCopy:     "Copying",
+	strategyHardlink: "Hard linking",
+	strategyTemplate: "Rendering",
+	strategyBlock:    "Updating block in",
+}
+
+// Get an action cloning this repo into the home directory, or updating the clone if it's there
+func cloneAction(home string) action {
+	repoDir := Config.repoDir(home)
+	if _, err := os.Stat(repoDir + "/.git"); err == nil {
+		return action{
+			msg:     fmt.Sprintf("Updating ~/.%s", Config.Metadata.Repo),
+			command: fmt.Sprintf("git -C %s pull --ff-only", repoDir),
+		}
+	}
+	gitClone := fmt.Sprintf("git clone https://github.com/%s/%s.git ~/.%s", Config.Metadata.User, Config.Metadata.Repo, Config.Metadata.Repo)
+	gitCloneMsg := fmt.Sprintf("Cloning github.com/%s/%s to ~/.%s", Config.Metadata.User, Config.Metadata.Repo, Config.Metadata.Repo)
+	return action{msg: gitCloneMsg, command: gitClone}
+}
+
+// Split the argument of @save into a glob pattern and, if given with ->, a destination
+func parseSave(arg string) (pattern, dest string) {
+	pattern, dest, _ = strings.Cut(arg, "->")
+	return strings.TrimSpace(pattern), strings.TrimSpace(dest)
+}
+
+// Work out which repo files an @save step saves, and where. The pattern is matched against whole
+// repo paths; a matching directory is saved file by file if it's a sync target. Without a
+// destination, files go to their sync target's local path, so they must be sync targets. A
+// destination ending in /, or given for a wildcard pattern or directory, is a directory files are
+// saved in, keeping their paths below the pattern's fixed part. Also returns the directory targets
+// to prune afterwards
+func savedFiles(arg string, tmp bool, installDir string) ([]savedFile, []Target, error) {
+	pattern, dest := parseSave(arg)
+
+	var files []savedFile
+	var pruned []Target
+	for _, p := range Config.Metadata.GitPaths {
+		if matched, err := globMatch(pattern, p); err != nil {
+			return nil, nil, fmt.Errorf("@save %s: %w", arg, err)
+		} else if !matched {
+			continue
+		}
+
+		// Directories are only saved if they're sync targets, in which case each file in them is
+		repoPaths := []string{p}
+		base := globBase(pattern)
+		if Config.Metadata.isDir(p) {
+			t, isTarget := Config.target(p)
+			if !isTarget || t.RepoPath != p {
+				continue
+			}
+			repoPaths = nil
+			for _, f := range t.files() {
+				repoPaths = append(repoPaths, f.RepoPath)
+			}
+			if !hasGlob(pattern) {
+				base = p
+			}
+			if t.Prune && !tmp && dest == "" {
+				pruned = append(pruned, t)
+			}
+		}
+
+		for _, p := range repoPaths {
+			// Work out where to save the file
+			var localPath string
+			t, isTarget := Config.target(p)
+			switch {
+			case dest != "" && (strings.HasSuffix(dest, "/") || hasGlob(pattern) || base == pattern):
+				localPath = strings.TrimSuffix(dest, "/") + "/" + strings.TrimPrefix(p, base+"/")
+			case dest != "":
+				localPath = dest
+			case tmp:
+				// Keep the repo layout in the tmp dir
+				localPath = "~/" + p
+			case isTarget:
+				// If file is in sync targets, use that path
+				localPath = t.LocalPath
+			default:
+				return nil, nil, fmt.Errorf("@save %s: %s isn't a sync target, so give a destination with ->", arg, p)
+			}
+
+			// Target hooks only run when saving a target to its own place, never in temporary installs
+			if tmp || !isTarget || expandPath(localPath, installDir) != expandPath(t.LocalPath, installDir) {
+				t = Target{RepoPath: p}
+			}
+			files = append(files, savedFile{target: t, localPath: expandPath(localPath, installDir)})
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("@save %s: no files in the repo match %q", arg, pattern)
+	}
+	return files, pruned, nil
+}
+
+// Get the steps an installer runs, using its tmp install rules for temporary installs if it has any
+func installerSteps(flag string, tmp bool) []Step {
+	i := Config.Installers[flag]
+	if tmp && i.TmpInstall != nil {
+		return i.TmpInstall
+	}
+	return i.Install
+}
+
+// Get the packages an installer installs with @install steps that always run
+func installerPackages(flag string, tmp bool) []string {
+	var names []string
+	for _, step := range installerSteps(flag, tmp) {
+		cmd := strings.TrimSpace(step.Cmd)
+		if strings.HasPrefix(cmd, "@install") && strings.TrimSpace(step.When) == "" && strings.TrimSpace(step.Unless) == "" {
+			names = append(names, strings.TrimSpace(strings.TrimPrefix(cmd, "@install")))
+		}
+	}
+	return names
+}
+
 // Return all actions for a given flag
 func install(flag string, tmp bool) []action {
 	// Get install directory (defaults to home), and replace all instances of ~ with it
@@ -20,156 +147,172 @@ func install(flag string, tmp bool) []action {
 
 	// Get install actions for flag from TOML config
 	i := Config.Installers[flag]
-	installer := i.Install
+	installer := installerSteps(flag, tmp)
 	if tmp {
 		// Change install dir to if tmp install
-		installDir = strings.ReplaceAll(Config.TmpDir, "@repo_name", Config.Metadata.Repo)
-
-		// If there's a tmp install rule set, use that
-		if i.TmpInstall != nil {
-			installer = i.TmpInstall
-		}
+		installDir = tmpDir()
 	}
 
 	// Ensure install dir exists
 	runCommand("mkdir -p " + installDir)
 
-	// Keep track of packages to uninstall if tmp install
-	installFound := false
-	var uninstallCommands []string
+	// Keep track of packages installed, and what a tmp install adds so it can be undone
+	var installed []string
+	needClone := false
+	added := tmpManifest{Dirs: []string{installDir}}
+	var newPackages []string
 
 	// Iterate through install actions, formatting properly, and adding to actions
 	var actions []action
-	for _, a := range installer {
-		// Get action parameters
-		msg := a["msg"]
-		cmd := a["cmd"]
+	for _, step := range installer {
+		// Get action command
+		cmd := step.Cmd
 
 		if strings.HasPrefix(cmd, "@install") {
 			// Note that install was found
-			installFound = true
-
-			// Add package install action
 			name := strings.TrimSpace(strings.TrimPrefix(cmd, "@install"))
-			actions = append(actions, action{msg, PM.installCmd(name)})
+			installed = append(installed, name)
+
+			// Add package install action, keeping the step's conditions
+			a := step.action(installDir)
+			pa := PM.installAction(name, step.Msg)
+			a.msg, a.command = pa.msg, pa.command
+			actions = append(actions, a)
 
-			// Add uninstall command for package if --tmp passed
+			// Only packages that aren't installed yet are uninstalled with a tmp install
 			if tmp {
-				uninstallCommands = append(uninstallCommands, PM.uninstallCmd(name))
+				if present, _ := PM.installedVersion(name); !present {
+					newPackages = append(newPackages, name)
+				}
 			}
 		} else if strings.HasPrefix(cmd, "@save") {
-			// Get file to save and turn into regex pattern — allows for wildcard matching
-			filesToSave := strings.TrimSpace(strings.TrimPrefix(cmd, "@save"))
-			regexpPatttern := strings.ReplaceAll(filesToSave, "*", ".*")
-
-			// Find matches
-			var matchedFiles []string
-			for _, p := range Config.Metadata.GitPaths {
-				// Check if file matches pattern
-				matched, err := regexp.Match(regexpPatttern, []byte(p))
-				if err != nil {
-					log.Fatal(err)
+			// Find the files to save, and where to save them
+			files, pruned, err := savedFiles(strings.TrimSpace(strings.TrimPrefix(cmd, "@save")), tmp, installDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// Files are copied unless their strategy says otherwise, and links need the cloned repo
+			repoDir := Config.repoDir(installDir)
+			for i, f := range files {
+				files[i].strategy = f.target.strategy(strategyCopy, tmp)
+				files[i].before, _ = os.ReadFile(f.localPath)
+				if needsClone(files[i].strategy) {
+					needClone = true
 				}
-				if matched {
-					// If file matches, add properly formatted curl command to download it
-					var localPath string
-					if tmp && contains(Config.Metadata.GitPaths, p) {
-						// Get local parent dir of non-tmp install and add vanilla file name
-						splitPath := strings.Split(p, "/")
-						localPath = fmt.Sprintf("%s/%s%s", installDir, parentDir(p), splitPath[len(splitPath)-1])
-					} else {
-						if lp := Config.SyncTargets()[p]; lp != "" {
-							// If file is in sync targets, use that path
-							localPath = lp
-						} else {
-							// Otherwise, use repo path prepended with "~/.", assuming it's a dotfile in the root dir
-							localPath = "~/." + p
-						}
-					}
-					localPath = strings.ReplaceAll(localPath, "~", installDir)
-					curl := fmt.Sprintf("curl -fsSLo %s %s", localPath, Config.Metadata.BaseURL+p)
+				added.Files = append(added.Files, f.localPath)
+				added.Dirs = append(added.Dirs, missingDirs(f.localPath, installDir)...)
+			}
 
-					// If parent directory is not ~, ensure directory exists before running curl command
-					if pd := parentDir(localPath); pd != installDir {
-						curl = fmt.Sprintf("mkdir -p %s; %s", pd, curl)
+			a := step.action(installDir)
+			a.fn = func() error {
+				for _, f := range files {
+					content := func() ([]byte, error) { return fetch(Config.Metadata.BaseURL + f.target.RepoPath) }
+					if err := placeTarget(f.target, f.localPath, f.strategy, repoDir+"/"+f.target.RepoPath, f.before, content, installDir); err != nil {
+						return err
 					}
+				}
 
-					matchedFiles = append(matchedFiles, curl)
+				// Clear out files that have gone from directories with prune = true
+				for _, t := range pruned {
+					if _, err := pruneTarget(t, installDir); err != nil {
+						return err
+					}
 				}
+				return nil
 			}
-			actions = append(actions, action{msg, strings.Join(matchedFiles, "; ")})
+			actions = append(actions, a)
+		} else {
+			// Anything else is a shell command
+			actions = append(actions, step.action(installDir))
 		}
 	}
 
-	// Create and add uninstall script if --tmp passed
-	if len(uninstallCommands) > 0 {
-		uninstallScript := strings.Join(uninstallCommands, "; ") + fmt.Sprintf("; rm -rf %s", installDir)
-		uninstallAction := fmt.Sprintf("echo '%s' > %s/uninstall.sh", uninstallScript, installDir)
-		actions = append(actions, action{"Adding uninstall script", uninstallAction})
+	// Clone the repo first if any files link to it
+	if needClone {
+		actions = append([]action{cloneAction(installDir)}, actions...)
 	}
 
-	// Prepend package manager update action if install was found
-	if installFound {
-		actions = append([]action{{"Updating package manager", PM.commands.updateCmd}}, actions...)
+	// Wrap with installer hooks, which only apply to real installs
+	if !tmp {
+		actions = append(stepActions(i.Pre, installDir), actions...)
+		actions = append(actions, stepActions(i.Post, installDir)...)
 	}
 
+	// Record what a tmp install adds in its manifest and uninstall script
+	if tmp {
+		actions = append(actions, recordAction(flag, installDir, added, newPackages))
+	}
+
+	// Prepend package manager update actions if install was found
+	actions = append(PM.updateActions(installed), actions...)
+
 	return actions
 }
 
 // Full config/install
 func fullConfig() []action {
-	// First, update the package manaer
-	actions := []action{{"Updating package manager", PM.commands.updateCmd}}
+	// First, update the package managers
+	var allPackages []string
+	for group := range PM.Packages {
+		allPackages = append(allPackages, PM.groupPackages(group)...)
+	}
+	actions := PM.updateActions(allPackages)
 
 	// Install homebrew if necessary
 	if runtime.GOOS == "darwin" && !commandExists("brew") {
 		brewInstallCommand := "NONINTERACTIVE=1 /bin/bash -c \"$(curl -fsSL https://raw.githubusercontent.com/Homebrew/install/HEAD/install.sh)\""
-		actions = append(actions, action{brewInstallCommand, "Installing Homebrew"})
+		actions = append(actions, action{msg: "Installing Homebrew", command: brewInstallCommand})
 	}
 
-	// Install packages
-	// Sort packages by group name, irrespective of case
-	var packageGroups []string
-	for group := range PM.Packages {
-		packageGroups = append(packageGroups, group)
-	}
+	// Install packages from every group together
+	actions = append(actions, PM.packageInstallActions(allPackages)...)
 
-	// Add package install actions and note requirements
-	for _, packageGroup := range Sorted(packageGroups) {
-		// Add packages actions
-		actions = append(actions, PM.packageInstallActions(packageGroup)...)
+	// Clone this repo into home directory, or update the existing clone
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal(err)
 	}
+	actions = append(actions, cloneAction(home))
 
-	// Clone this repo into home directory
-	gitClone := fmt.Sprintf("git clone https://github.com/%s/%s.git ~/.%s", Config.Metadata.User, Config.Metadata.Repo, Config.Metadata.Repo)
-	gitCloneMsg := fmt.Sprintf("Cloning github.com/%s/%s to ~/.%s", Config.Metadata.User, Config.Metadata.Repo, Config.Metadata.Repo)
-	actions = append(actions, action{gitCloneMsg, gitClone})
-
-	// Create symlinks for dotfiles
-	var symlinkActions []action
-	for repoPath, localPath := range Config.SyncTargets() {
-		msg := fmt.Sprintf("Creating %s symlink", localPath)
-		symlink := fmt.Sprintf("ln -sf ~/.%s/%s %s", Config.Metadata.Repo, repoPath, localPath)
-
-		// Get parent directory of localPath
-		splitLocalPath := strings.Split(localPath, "/")
-		parentDir := strings.Join(splitLocalPath[:len(splitLocalPath)-1], "/")
-
-		// If parent directory is not ~, ensure directory exists before creating symlink
-		if parentDir != "~" {
-			symlink = fmt.Sprintf("mkdir -p %s; %s", parentDir, symlink)
+	// Link dotfiles into place (clearing out links to files no longer in the config), and put the
+	// rest in place however their strategy says
+	var linked []Target
+	var placeActions []action
+	repoDir := Config.repoDir(home)
+	for _, t := range Config.hostTargets() {
+		strategy := t.strategy(strategySymlink, false)
+		if strategy == strategySymlink {
+			linked = append(linked, t)
+			continue
 		}
 
-		symlinkActions = append(symlinkActions, action{msg, symlink})
+		path := expandPath(t.LocalPath, home)
+		repoFile := repoDir + "/" + t.RepoPath
+		before, _ := os.ReadFile(path)
+		placeActions = append(placeActions, action{
+			msg: fmt.Sprintf("%s %s", strategyVerbs[strategy], t.LocalPath),
+			fn: func() error {
+				return placeTarget(t, path, strategy, repoFile, before, func() ([]byte, error) { return os.ReadFile(repoFile) }, home)
+			},
+		})
 	}
+	actions = append(actions, linkActions(linked, home)...)
+	actions = append(actions, placeActions...)
 
-	// Sort symlink actions by message, irrespective of case
-	sort.SliceStable(symlinkActions, func(i, j int) bool {
-		return strings.ToLower(symlinkActions[i].msg) < strings.ToLower(symlinkActions[j].msg)
-	})
-
-	// Add symlink actions to actions
-	actions = append(actions, symlinkActions...)
+	// Clear out files that have gone from directories with prune = true, like @save does. Linked
+	// directories don't need it, since links that have gone are removed as stale
+	for _, t := range Config.pruneTargets() {
+		if t.strategy(strategySymlink, false) == strategySymlink {
+			continue
+		}
+		actions = append(actions, action{
+			msg: fmt.Sprintf("Pruning %s", t.LocalPath),
+			fn: func() error {
+				_, err := pruneTarget(t, home)
+				return err
+			},
+		})
+	}
 
 	return actions
 }
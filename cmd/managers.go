@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// PackageManager is a system package manager. Update, Install and Uninstall return shell commands
+// to be run as actions, while Detect, IsInstalled and Version query the system directly. Packages
+// are the manager's own package names from packages.toml, keyed by the manager's Name().
+type PackageManager interface {
+	Name() string
+	Detect() bool
+	Update() string
+	Install(packages ...string) string
+	Uninstall(packages ...string) string
+	IsInstalled(pkg string) bool
+	Version(pkg string) string
+}
+
+// All supported package managers, in detection order
+var packageManagers = []PackageManager{
+	pacman{cliManager{"pacman", "pacman", "pacman -Syu --noconfirm", "pacman -S --noconfirm --needed", "pacman -Rs --noconfirm"}},
+	dnf{cliManager{"dnf", "dnf", "dnf makecache", "dnf install -y", "dnf remove -y"}},
+	brew{cliManager{"brew", "brew", "brew update", "brew install", "brew uninstall"}},
+	apt{cliManager{"apt", "apt", "apt update", "apt install -y", "apt remove -y"}},
+	zypper{cliManager{"zypper", "zypper", "zypper --non-interactive refresh", "zypper --non-interactive install", "zypper --non-interactive remove"}},
+	apk{cliManager{"apk", "apk", "apk update", "apk add", "apk del"}},
+	xbps{cliManager{"xbps", "xbps-install", "xbps-install -S", "xbps-install -y", "xbps-remove -y"}},
+	nixEnv{cliManager{"nix-env", "nix-env", "nix-channel --update", "nix-env -iA", "nix-env -e"}},
+}
+
+// Get a package manager by name
+func packageManagerByName(name string) (PackageManager, bool) {
+	for _, m := range packageManagers {
+		if m.Name() == name {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// Shared behaviour for package managers driven by a command line tool
+type cliManager struct {
+	name         string
+	binary       string
+	updateCmd    string
+	installCmd   string
+	uninstallCmd string
+}
+
+func (m cliManager) Name() string   { return m.name }
+func (m cliManager) Detect() bool   { return commandExists(m.binary) }
+func (m cliManager) Update() string { return m.updateCmd }
+
+// Package names may include flags (e.g. "--cask iterm2"), so join them as-is
+func (m cliManager) Install(packages ...string) string {
+	return m.installCmd + " " + strings.Join(packages, " ")
+}
+
+func (m cliManager) Uninstall(packages ...string) string {
+	return m.uninstallCmd + " " + strings.Join(packages, " ")
+}
+
+// Run a query command, returning its trimmed output or an empty string if it fails
+func query(name string, args ...string) string {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Strip "name-" from the front of a "name-version" string
+func trimPackageName(s, pkg string) string {
+	return strings.TrimPrefix(s, pkg+"-")
+}
+
+type pacman struct{ cliManager }
+
+func (m pacman) IsInstalled(pkg string) bool { return m.Version(pkg) != "" }
+
+// `pacman -Q bat` prints "bat 0.24.0-1"
+func (m pacman) Version(pkg string) string {
+	if f := strings.Fields(query("pacman", "-Q", pkg)); len(f) == 2 {
+		return f[1]
+	}
+	return ""
+}
+
+// Query the RPM database, which both dnf and zypper install into
+func rpmVersion(pkg string) string {
+	return query("rpm", "-q", "--queryformat", "%{VERSION}-%{RELEASE}", pkg)
+}
+
+type dnf struct{ cliManager }
+
+func (m dnf) IsInstalled(pkg string) bool { return m.Version(pkg) != "" }
+func (m dnf) Version(pkg string) string   { return rpmVersion(pkg) }
+
+type zypper struct{ cliManager }
+
+func (m zypper) IsInstalled(pkg string) bool { return m.Version(pkg) != "" }
+func (m zypper) Version(pkg string) string   { return rpmVersion(pkg) }
+
+type brew struct{ cliManager }
+
+// Casks are listed as "--cask name", and brew applies --cask to every package in a command, so
+// install formulae and casks separately
+func (m brew) Install(packages ...string) string {
+	var formulae, casks []string
+	for _, p := range packages {
+		if strings.HasPrefix(p, "--cask ") {
+			casks = append(casks, strings.TrimSpace(strings.TrimPrefix(p, "--cask ")))
+		} else {
+			formulae = append(formulae, p)
+		}
+	}
+	var commands []string
+	if len(formulae) > 0 {
+		commands = append(commands, m.cliManager.Install(formulae...))
+	}
+	if len(casks) > 0 {
+		commands = append(commands, m.cliManager.Install(append([]string{"--cask"}, casks...)...))
+	}
+	return strings.Join(commands, " && ")
+}
+
+func (m brew) IsInstalled(pkg string) bool { return m.Version(pkg) != "" }
+
+// `brew list --versions bat` prints "bat 0.23.0 0.24.0", newest last. Casks are passed as
+// "--cask name", so keep the flag
+func (m brew) Version(pkg string) string {
+	args := append([]string{"list", "--versions"}, strings.Fields(pkg)...)
+	if f := strings.Fields(query("brew", args...)); len(f) > 1 {
+		return f[len(f)-1]
+	}
+	return ""
+}
+
+type apt struct{ cliManager }
+
+func (m apt) IsInstalled(pkg string) bool { return m.Version(pkg) != "" }
+
+// Packages that were removed but not purged are still known to dpkg, so check the status too
+func (m apt) Version(pkg string) string {
+	if f := strings.Fields(query("dpkg-query", "-W", "-f=${db:Status-Status} ${Version}", pkg)); len(f) == 2 && f[0] == "installed" {
+		return f[1]
+	}
+	return ""
+}
+
+type apk struct{ cliManager }
+
+func (m apk) IsInstalled(pkg string) bool {
+	return exec.Command("apk", "info", "-e", pkg).Run() == nil
+}
+
+// `apk list -I bat` prints "bat-0.24.0-r0 x86_64 {bat} (Apache-2.0) [installed]"
+func (m apk) Version(pkg string) string {
+	if f := strings.Fields(query("apk", "list", "-I", pkg)); len(f) > 0 {
+		return trimPackageName(f[0], pkg)
+	}
+	return ""
+}
+
+type xbps struct{ cliManager }
+
+func (m xbps) IsInstalled(pkg string) bool { return m.Version(pkg) != "" }
+
+// `xbps-query -p pkgver bat` prints "bat-0.24.0_1"
+func (m xbps) Version(pkg string) string {
+	return trimPackageName(query("xbps-query", "-p", "pkgver", pkg), pkg)
+}
+
+// Packages are installed by attribute path (e.g. "nixpkgs.bat") but queried and removed by name
+type nixEnv struct{ cliManager }
+
+// Get the package name from an attribute path
+func nixName(pkg string) string {
+	return pkg[strings.LastIndex(pkg, ".")+1:]
+}
+
+func (m nixEnv) Uninstall(packages ...string) string {
+	var names []string
+	for _, p := range packages {
+		names = append(names, nixName(p))
+	}
+	return m.cliManager.Uninstall(names...)
+}
+
+func (m nixEnv) IsInstalled(pkg string) bool { return m.Version(pkg) != "" }
+
+// `nix-env -q bat` prints "bat-0.24.0"
+func (m nixEnv) Version(pkg string) string {
+	name := nixName(pkg)
+	return trimPackageName(query("nix-env", "-q", name), name)
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What temporary installs added, so they can be undone without touching anything that was there
+// before. Each installer's additions are merged into manifest.json in the temporary directory
+type tmpManifest struct {
+	Packages []tmpPackage `json:"packages"` // packages that weren't installed before
+	Files    []string     `json:"files"`
+	Dirs     []string     `json:"dirs"`
+	Expires  time.Time    `json:"expires,omitzero"` // when gc can remove it, if ever
+}
+
+// How long temporary installs made in this run last, set with --ttl
+var tmpTTL time.Duration
+
+// A package added by a temporary install, with the command that removes it again
+type tmpPackage struct {
+	Name      string `json:"name"`
+	Uninstall string `json:"uninstall"`
+}
+
+// Files every temporary install generates in its directory, besides the dotfiles it saves
+var tmpGeneratedFiles = []string{"activate", ".zshenv", "manifest.json", "uninstall.sh"}
+
+// Read the manifest of the temporary install in dir, which is empty if there isn't one
+func readManifest(dir string) (tmpManifest, error) {
+	var m tmpManifest
+	b, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(b, &m)
+}
+
+// Check if a temporary install has expired
+func (m tmpManifest) expired() bool {
+	return !m.Expires.IsZero() && time.Now().After(m.Expires)
+}
+
+// Add what another installer added to the manifest, leaving out anything already in it. An expiry
+// replaces the one before, so installing again with --ttl extends it
+func (m *tmpManifest) merge(other tmpManifest) {
+	if !other.Expires.IsZero() {
+		m.Expires = other.Expires
+	}
+	for _, p := range other.Packages {
+		found := false
+		for _, existing := range m.Packages {
+			found = found || existing.Name == p.Name
+		}
+		if !found {
+			m.Packages = append(m.Packages, p)
+		}
+	}
+	for _, f := range other.Files {
+		if !contains(m.Files, f) {
+			m.Files = append(m.Files, f)
+		}
+	}
+	for _, d := range other.Dirs {
+		if !contains(m.Dirs, d) {
+			m.Dirs = append(m.Dirs, d)
+		}
+	}
+}
+
+// Get the actions undoing the temporary install in dir: uninstalling its packages, then removing
+// its files and any of its directories left empty, deepest first
+func (m tmpManifest) uninstallActions(dir string) []action {
+	var actions []action
+	for _, p := range m.Packages {
+		actions = append(actions, action{msg: "Uninstalling " + p.Name, command: p.Uninstall, ignoreErrors: true})
+	}
+
+	files := append([]string{}, m.Files...)
+	for _, name := range tmpGeneratedFiles {
+		files = append(files, filepath.Join(dir, name))
+	}
+	var quoted []string
+	for _, f := range files {
+		quoted = append(quoted, shellQuote(f))
+	}
+	actions = append(actions, action{msg: "Removing files", command: "rm -f -- " + strings.Join(quoted, " ")})
+
+	dirs := append([]string{}, m.Dirs...)
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], "/") > strings.Count(dirs[j], "/")
+	})
+	quoted = nil
+	for _, d := range dirs {
+		quoted = append(quoted, shellQuote(d))
+	}
+	if len(quoted) > 0 {
+		// Directories still holding something that wasn't saved by the install are kept
+		actions = append(actions, action{msg: "Removing empty directories", command: "rmdir -- " + strings.Join(quoted, " ") + " 2>/dev/null || true"})
+	}
+	return actions
+}
+
+// Write a manifest to the temporary install in dir, along with the uninstall script it implies
+func (m tmpManifest) write(dir string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	lines := []string{"#!/bin/sh", "# Undo the temporary install in " + dir + " (or run `shell-config uninstall --tmp`)"}
+	for _, a := range m.uninstallActions(dir) {
+		lines = append(lines, "", "# "+a.msg, a.command)
+	}
+	return os.WriteFile(filepath.Join(dir, "uninstall.sh"), joinLines(lines), 0755)
+}
+
+// Get an action recording what an installer's temporary install added. Packages are only recorded
+// if they're installed once it's run, since they weren't before
+func recordAction(flag, dir string, added tmpManifest, packages []string) action {
+	return action{
+		msg: "Adding " + flag + " to uninstall script",
+		fn: func() error {
+			if tmpTTL > 0 {
+				added.Expires = time.Now().Add(tmpTTL).Truncate(time.Second)
+			}
+			for _, name := range packages {
+				if installed, _ := PM.installedVersion(name); installed {
+					added.Packages = append(added.Packages, tmpPackage{name, PM.uninstallCmd(name)})
+				}
+			}
+			m, err := readManifest(dir)
+			if err != nil {
+				return err
+			}
+			m.merge(added)
+			return m.write(dir)
+		},
+	}
+}
+
+// Get the directories inside dir that saving a file at path would create
+func missingDirs(path, dir string) []string {
+	var dirs []string
+	for p := filepath.Dir(path); p != dir && within(p, dir); p = filepath.Dir(p) {
+		if _, err := os.Stat(p); err == nil {
+			break
+		}
+		dirs = append(dirs, p)
+	}
+	return dirs
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// How to handle a dotfile when both the local copy and the repo changed and can't be merged
+type conflictPolicy string
+
+const (
+	conflictMarkers  conflictPolicy = "markers"  // write the file with git-style conflict markers
+	conflictLocal    conflictPolicy = "local"    // keep the local file
+	conflictUpstream conflictPolicy = "upstream" // overwrite with the repo version
+	conflictAsk      conflictPolicy = "ask"      // ask in the TUI
+)
+
+// Conflict policy for this run, set with --on-conflict
+var onConflict = conflictMarkers
+
+// Running TUI program, so actions can ask the user how to resolve conflicts
+var program *tea.Program
+
+// Get the directory this tool keeps its state in
+func stateDir() string {
+	return filepath.Join(xdgHome("state"), "shell-config")
+}
+
+// Get where the last applied repo version of a local file is kept
+func basePath(localPath string) string {
+	return filepath.Join(stateDir(), "base", strings.TrimPrefix(localPath, "/"))
+}
+
+// Get the last applied repo version of a local file, if there is one
+func readBase(localPath string) ([]byte, bool) {
+	base, err := os.ReadFile(basePath(localPath))
+	return base, err == nil
+}
+
+// Remember the repo version just applied to a local file
+func writeBase(localPath string, content []byte) error {
+	path := basePath(localPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0600)
+}
+
+// Three-way merge local and upstream changes to a file with `git merge-file`, returning the result
+// and whether it has conflicts (marked with <<<<<<< ======= >>>>>>>)
+func mergeFiles(local, base, upstream []byte) ([]byte, bool, error) {
+	dir, err := os.MkdirTemp("", "shell-config-merge")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string][]byte{"local": local, "base": base, "upstream": upstream} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// merge-file exits with the number of conflicts, or a negative status on error
+	cmd := exec.Command("git", "merge-file", "-p", "-L", "local", "-L", "base", "-L", "upstream",
+		filepath.Join(dir, "local"), filepath.Join(dir, "base"), filepath.Join(dir, "upstream"))
+	merged, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 && exitErr.ExitCode() < 128 {
+		return merged, true, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("git merge-file: %w", err)
+	}
+	return merged, false, nil
+}
+
+// Work out what to write to a local file that differs from the repo version, using the last
+// applied version as the base of a three-way merge. Returns nil if the local file should be kept,
+// and whether what's returned has conflict markers in it. A file that was never applied has no
+// base, so it's kept unless --on-conflict says otherwise, since nothing can be merged
+func reconcile(t Target, localPath string, local, upstream []byte) ([]byte, bool, error) {
+	base, ok := readBase(localPath)
+	switch {
+	case ok && bytes.Equal(local, base):
+		// Only the repo changed
+		return upstream, false, nil
+	case ok && bytes.Equal(upstream, base):
+		// Only the local file changed, so keep it
+		return nil, false, nil
+	}
+
+	// Both changed (or there's nothing to tell), so merge
+	merged, conflicted, err := mergeFiles(local, base, upstream)
+	if err != nil || !conflicted {
+		return merged, false, err
+	}
+
+	policy := onConflict
+	if policy == conflictAsk {
+		policy = askConflict(t, localPath, merged)
+	} else if !ok && policy == conflictMarkers {
+		policy = conflictLocal
+	}
+	switch policy {
+	case conflictLocal:
+		return nil, false, nil
+	case conflictUpstream:
+		return upstream, false, nil
+	}
+	return merged, true, nil
+}
+
+// Message asking the TUI how to resolve a conflict, with a channel for the answer
+type conflictMsg struct {
+	target    Target
+	localPath string
+	merged    []byte
+	reply     chan conflictPolicy
+}
+
+// Ask the user how to resolve a conflict, falling back to conflict markers outside the TUI
+func askConflict(t Target, localPath string, merged []byte) conflictPolicy {
+	if program == nil {
+		return conflictMarkers
+	}
+	reply := make(chan conflictPolicy)
+	program.Send(conflictMsg{t, localPath, merged, reply})
+	return <-reply
+}
+
+// Get the conflicting sections of a merged file, for showing in the TUI
+func conflictHunks(merged []byte, maxLines int) string {
+	var lines []string
+	inConflict := false
+	for _, line := range strings.Split(string(merged), "\n") {
+		if strings.HasPrefix(line, "<<<<<<<") {
+			inConflict = true
+		}
+		if inConflict {
+			lines = append(lines, line)
+		}
+		if strings.HasPrefix(line, ">>>>>>>") {
+			inConflict = false
+		}
+	}
+	if len(lines) > maxLines {
+		lines = append(lines[:maxLines], fmt.Sprintf("… %d more lines", len(lines)-maxLines))
+	}
+	return strings.Join(lines, "\n")
+}
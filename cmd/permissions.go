@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Directories that programs insist are private, so targets in them default to mode 0600 and
+// dir_mode 0700
+var privateDirs = []string{"~/.gnupg", "~/.ssh"}
+
+// Permissions a target's local file should have. Zero modes and an empty owner are left alone
+type permissions struct {
+	mode    os.FileMode
+	dirMode os.FileMode
+	owner   string // user or user:group
+}
+
+// Parse an octal mode like "0600"
+func parseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, should be octal like \"0644\"", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Get the permissions a target's local file (at path) should have, from its own settings or the
+// defaults for private directories and encrypted targets, which only their owner can read
+func (t Target) permissions(path, home string) permissions {
+	var p permissions
+	if t.Encrypted {
+		p.mode = 0600
+	}
+	for _, dir := range privateDirs {
+		if within(path, expandPath(dir, home)) {
+			p.mode, p.dirMode = 0600, 0700
+		}
+	}
+	if mode, err := parseMode(t.Mode); err == nil {
+		p.mode = mode
+	}
+	if mode, err := parseMode(t.DirMode); err == nil {
+		p.dirMode = mode
+	}
+	p.owner = t.Owner
+	return p
+}
+
+// Look up the user and group IDs for an owner like user or user:group. Without a group, the user's
+// primary group is used
+func lookupOwner(owner string) (int, int, error) {
+	name, group, hasGroup := strings.Cut(owner, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid = g.Gid
+	}
+	uidNum, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gidNum, err := strconv.Atoi(gid)
+	return uidNum, gidNum, err
+}
+
+// Get the owner and group IDs of a file
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// Check a target's local file and its directory against the permissions they should have,
+// returning what's wrong
+func checkPermissions(t Target, path, home string) []string {
+	want := t.permissions(path, home)
+	var problems []string
+
+	check := func(p string, mode os.FileMode, what string) {
+		info, err := os.Stat(p)
+		if err != nil {
+			return
+		}
+		if mode != 0 && info.Mode().Perm() != mode {
+			problems = append(problems, fmt.Sprintf("%s mode %04o, want %04o", what, info.Mode().Perm(), mode))
+		}
+		if want.owner == "" {
+			return
+		}
+		uid, gid, err := lookupOwner(want.owner)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("owner %s: %s", want.owner, err))
+			return
+		}
+		if fileUID, fileGID, ok := fileOwner(info); ok && (fileUID != uid || fileGID != gid) {
+			problems = append(problems, fmt.Sprintf("%s owned by %d:%d, want %s", what, fileUID, fileGID, want.owner))
+		}
+	}
+	check(path, want.mode, "file")
+	check(filepath.Dir(path), want.dirMode, "directory")
+	return problems
+}
+
+// Give a target's local file (at path) and its directory the permissions they should have. Links
+// are followed, so for linked targets this sets the mode of the file in the cloned repo (git only
+// tracks whether files are executable, so this doesn't show up as a change)
+func applyPermissions(t Target, path, home string) error {
+	want := t.permissions(path, home)
+	dir := filepath.Dir(path)
+
+	if want.dirMode != 0 {
+		if err := os.Chmod(dir, want.dirMode); err != nil {
+			return err
+		}
+	}
+	if want.mode != 0 {
+		if err := os.Chmod(path, want.mode); err != nil {
+			return err
+		}
+	}
+	if want.owner == "" {
+		return nil
+	}
+
+	// Only chown when needed, since it usually takes root
+	uid, gid, err := lookupOwner(want.owner)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{dir, path} {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if fileUID, fileGID, ok := fileOwner(info); ok && fileUID == uid && fileGID == gid {
+			continue
+		}
+		if err := os.Chown(p, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
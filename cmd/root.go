@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -21,7 +22,38 @@ func flagPresent(cmd *cobra.Command, flagName string) bool {
 var rootCmd = &cobra.Command{
 	Use:   fmt.Sprintf("sh <(curl %s) [flags]", Config.InstallURL),
 	Short: Config.HelpDescription,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// Put package managers passed with --package-manager first
+		managers, err := cmd.Flags().GetStringSlice("package-manager")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(managers) > 0 {
+			PM.prefer(managers)
+		}
+
+		// Check how to handle dotfiles changed both locally and in the repo
+		policy, err := cmd.Flags().GetString("on-conflict")
+		if err != nil {
+			log.Fatal(err)
+		}
+		onConflict = conflictPolicy(policy)
+		if !contains([]string{"markers", "local", "upstream", "ask"}, policy) {
+			log.Fatalf("Unknown --on-conflict %q, use markers, local, upstream or ask", policy)
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
+		// Temporary installs can expire, for gc to remove
+		ttl, err := cmd.Flags().GetDuration("ttl")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ttl != 0 && (!flagPresent(cmd, "tmp") || ttl < 0) {
+			log.Fatal("--ttl needs --tmp and a positive duration, like --tmp --ttl 8h")
+		}
+		tmpTTL = ttl
+		forceLinks = flagPresent(cmd, "force")
+
 		options := map[string]bool{
 			"tmp":  flagPresent(cmd, "tmp"),
 			"full": flagPresent(cmd, "full"),
@@ -48,10 +80,24 @@ func init() {
 
 	// Add flag for temporary install
 	rootCmd.Flags().BoolP("tmp", "", false, "Install temporarily to "+Config.TmpDir)
+	rootCmd.Flags().Duration("ttl", 0, "With --tmp, how long until the temporary install expires and gc removes it (e.g. 8h)")
 
 	// Add flag for full install
 	rootCmd.Flags().BoolP("full", "", false, "Full shell config")
 
+	// Add flag for replacing local files with symlinks
+	rootCmd.Flags().BoolP("force", "", false, "Replace local files that differ from the repo when symlinking them")
+
+	// Add flag for choosing package managers
+	var managers []string
+	for _, m := range packageManagers {
+		managers = append(managers, m.Name())
+	}
+	rootCmd.PersistentFlags().StringSlice("package-manager", nil, "Package managers to use first, in order ("+strings.Join(managers, ", ")+")")
+
+	// Add flag for handling dotfiles changed both locally and in the repo
+	rootCmd.PersistentFlags().StringP("on-conflict", "", string(conflictMarkers), "When a dotfile changed locally and in the repo and can't be merged: markers, local, upstream or ask")
+
 	// Add flags for all installers
 	for flag, v := range Config.Installers {
 		rootCmd.Flags().BoolP(flag, "", false, v.HelpMessage)
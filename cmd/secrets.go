@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// Targets with encrypted = true are kept in the repo as age ciphertext (ASCII armored, so it
+// diffs as text). They're decrypted with the local identity file when they're put in place, and
+// encrypted again when they're captured
+
+// Get the path of the age identity file, from age_identity or the usual place for age keys
+func ageIdentityPath() string {
+	if Config.AgeIdentity != "" {
+		return expandHome(Config.AgeIdentity)
+	}
+	return xdgHome("config") + "/age/keys.txt"
+}
+
+// Identities from the age identity file, read once
+var ageIdentities []age.Identity
+
+// Read the age identities to decrypt targets with
+func loadIdentities() ([]age.Identity, error) {
+	if ageIdentities != nil {
+		return ageIdentities, nil
+	}
+	path := ageIdentityPath()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("encrypted targets need an age identity at %s (create one with `age-keygen -o %s`)", path, path)
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading age identity %s: %w", path, err)
+	}
+	ageIdentities = identities
+	return identities, nil
+}
+
+// Get who targets are encrypted for: the age_recipients in config.toml, plus the owner of the
+// local identity so this machine can always decrypt what it captures
+func ageRecipients() ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	seen := map[string]bool{}
+	for _, r := range Config.AgeRecipients {
+		parsed, err := age.ParseRecipients(strings.NewReader(r))
+		if err != nil {
+			return nil, fmt.Errorf("age_recipients: %w", err)
+		}
+		if !seen[r] {
+			seen[r] = true
+			recipients = append(recipients, parsed...)
+		}
+	}
+
+	identities, err := loadIdentities()
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range identities {
+		if x, ok := i.(*age.X25519Identity); ok && !seen[x.Recipient().String()] {
+			seen[x.Recipient().String()] = true
+			recipients = append(recipients, x.Recipient())
+		}
+	}
+	return recipients, nil
+}
+
+// Decrypt a target's repo content with the local identity file
+func decryptContent(name string, content []byte) ([]byte, error) {
+	identities, err := loadIdentities()
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = bytes.NewReader(content)
+	if bytes.HasPrefix(bytes.TrimLeft(content, " \t\r\n"), []byte(armor.Header)) {
+		r = armor.NewReader(r)
+	}
+	decrypted, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", name, err)
+	}
+	return io.ReadAll(decrypted)
+}
+
+// Encrypt content for the repo, armored
+func encryptContent(content []byte) ([]byte, error) {
+	recipients, err := ageRecipients()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	a := armor.NewWriter(&b)
+	w, err := age.Encrypt(a, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := a.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Get a target's plain content from what's in the repo, decrypting it if it's encrypted
+func (t Target) plainContent(content []byte) ([]byte, error) {
+	if !t.Encrypted {
+		return content, nil
+	}
+	return decryptContent(t.RepoPath, content)
+}
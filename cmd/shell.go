@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Temporary installs save dotfiles in the temporary directory rather than the home directory, so
+// nothing uses them by default. The activate script points programs at them instead, for the
+// shell that sources it:
+//
+//	. ~/.shell.tmp/activate
+
+// First line of the .zshenv written to start zsh with the temporary config
+const tmpZshenvHeader = "# Generated by shell-config for temporary installs"
+
+// Get the temporary install directory
+func tmpDir() string {
+	return expandHome(Config.TmpDir)
+}
+
+// Write the activate script for the temporary install in dir, going by the dotfiles saved there.
+// zsh reads its config from ZDOTDIR, vim from VIMINIT and tmux from -f, and dir/bin goes first in
+// PATH. Installs with an expiry warn once it's passed
+func writeActivateScript(dir string) error {
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	lines := []string{
+		"# Use the temporary shell config in " + dir + " by sourcing this script, or run a shell",
+		"# with it using `shell-config shell --tmp`",
+		"export SHELL_CONFIG_TMP=" + shellQuote(dir),
+		`case ":$PATH:" in`,
+		"*:" + shellQuote(dir+"/bin") + ":*) ;;",
+		"*) export PATH=" + shellQuote(dir+"/bin") + `:"$PATH" ;;`,
+		"esac",
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	if exists(".zshrc") {
+		lines = append(lines, "export ZDOTDIR="+shellQuote(dir))
+	}
+	if exists(".vimrc") {
+		// VIMINIT is an Ex command, where spaces in file names are escaped
+		lines = append(lines, "export VIMINIT="+shellQuote("source "+strings.ReplaceAll(dir+"/.vimrc", " ", `\ `)))
+	}
+	if exists(".tmux.conf") {
+		lines = append(lines, "alias tmux="+shellQuote("tmux -f "+shellQuote(dir+"/.tmux.conf")))
+	}
+	if !m.Expires.IsZero() {
+		warning := fmt.Sprintf("This temporary shell config expired at %s, remove it with `shell-config gc`", m.Expires.Format(time.DateTime))
+		lines = append(lines,
+			fmt.Sprintf(`if [ "$(date +%%s)" -ge %d ]; then`, m.Expires.Unix()),
+			"\techo "+shellQuote(warning)+" >&2",
+			"fi",
+		)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "activate"), joinLines(lines), 0644); err != nil {
+		return err
+	}
+
+	// zsh started with ZDOTDIR set to dir reads its .zshenv first, which sources the activate script
+	// so aliases are set too. A .zshenv saved by the install is left alone
+	zshenv := filepath.Join(dir, ".zshenv")
+	if content, err := os.ReadFile(zshenv); err == nil && !strings.HasPrefix(string(content), tmpZshenvHeader) {
+		return nil
+	}
+	return os.WriteFile(zshenv, joinLines([]string{tmpZshenvHeader, ". " + shellQuote(dir+"/activate")}), 0644)
+}
+
+// Get an action writing the activate script, once everything in a temporary install is saved
+func activateAction(dir string) action {
+	return action{
+		msg: "Adding activate script",
+		fn:  func() error { return writeActivateScript(dir) },
+	}
+}
+
+// Get a command starting a shell with the activate script for the temporary install in dir
+func tmpShellCommand(shell, dir string) *exec.Cmd {
+	activate := filepath.Join(dir, "activate")
+	c := exec.Command(shell)
+	c.Env = os.Environ()
+	switch filepath.Base(shell) {
+	case "zsh":
+		c.Env = append(c.Env, "ZDOTDIR="+dir)
+	case "bash":
+		c.Args = append(c.Args, "--rcfile", activate, "-i")
+	default:
+		// POSIX shells read $ENV when they start interactively
+		c.Env = append(c.Env, "ENV="+activate)
+	}
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return c
+}
+
+// Cobra shell command — starts a shell using a temporary install
+var shellCmd = &cobra.Command{
+	Use:   "shell --tmp",
+	Short: "Start a shell using the temporary install",
+	Long: "Start a subshell that uses the dotfiles from a temporary install (--tmp) instead of the " +
+		"ones in the home directory, which are left untouched. Exit the shell to go back.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !flagPresent(cmd, "tmp") {
+			log.Fatal("Only temporary installs need a shell of their own, so pass --tmp")
+		}
+		dir := tmpDir()
+		if _, err := os.Stat(filepath.Join(dir, "activate")); err != nil {
+			log.Fatalf("No temporary install in %s, install with --tmp first", dir)
+		}
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+
+		fmt.Printf("Starting %s with the temporary config in %s (exit to leave)\n", filepath.Base(shell), dir)
+		err := tmpShellCommand(shell, dir).Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		} else if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	shellCmd.Flags().BoolP("tmp", "", false, "Use the temporary install in "+Config.TmpDir)
+	rootCmd.AddCommand(shellCmd)
+}
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/spf13/cobra"
+)
+
+// Styles for status output
+var (
+	goodStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("42"))
+	warningStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("214"))
+	badStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("196"))
+	headerStyle  = lipgloss.NewStyle().Bold(true)
+)
+
+// Status of a package from packages.toml
+type packageStatus struct {
+	Group     string `json:"group"`
+	Name      string `json:"name"`
+	Manager   string `json:"manager"`
+	Installed bool   `json:"installed"`
+	Version   string `json:"version,omitempty"`
+}
+
+// Status of a sync target from config.toml
+type dotfileStatus struct {
+	Class       string      `json:"class"`
+	RepoPath    string      `json:"repo_path"`
+	LocalPath   string      `json:"local_path"`
+	State       targetState `json:"state"`
+	Permissions []string    `json:"permission_problems,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// Status of this machine relative to the config
+type machineStatus struct {
+	Packages []packageStatus `json:"packages"`
+	Dotfiles []dotfileStatus `json:"dotfiles"`
+}
+
+// Get the status of every package and dotfile that applies to this system
+func getStatus() machineStatus {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	status := machineStatus{Packages: []packageStatus{}, Dotfiles: []dotfileStatus{}}
+
+	// Packages that can be installed here, sorted by group then name
+	var groups []string
+	for group := range PM.Packages {
+		groups = append(groups, group)
+	}
+	for _, group := range Sorted(groups) {
+		for _, name := range PM.groupPackages(group) {
+			r, ok := PM.resolve(name)
+			if !ok {
+				continue
+			}
+			installed, version := PM.installedVersion(name)
+			status.Packages = append(status.Packages, packageStatus{group, name, r.via(), installed, version})
+		}
+	}
+
+	// Dotfiles, compared with the repo
+	for _, t := range Config.hostTargets() {
+		d := dotfileStatus{Class: t.class, RepoPath: t.RepoPath, LocalPath: t.LocalPath}
+		content, err := fetch(Config.Metadata.BaseURL + t.RepoPath)
+		if err == nil {
+			content, err = t.repoVersion(content, home)
+		}
+		if err == nil {
+			d.State, err = inspectTarget(t, home, content)
+		}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		d.Permissions = checkPermissions(t, expandPath(t.LocalPath, home), home)
+		status.Dotfiles = append(status.Dotfiles, d)
+	}
+
+	return status
+}
+
+// Colour a target state by how much attention it needs
+func styleState(state targetState) string {
+	switch state {
+	case stateLinked, stateIdentical:
+		return goodStyle.Render(string(state))
+	case stateModified:
+		return warningStyle.Render(string(state))
+	}
+	return badStyle.Render(string(state))
+}
+
+// Print status as tables
+func printStatus(status machineStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, headerStyle.Render("Packages"))
+	for _, p := range status.Packages {
+		state := badStyle.Render("missing")
+		if p.Installed {
+			state = goodStyle.Render("installed")
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", p.Group, p.Name, p.Manager, state, p.Version)
+	}
+
+	fmt.Fprintln(w, "\n"+headerStyle.Render("Dotfiles"))
+	for _, d := range status.Dotfiles {
+		state := styleState(d.State)
+		if d.Error != "" {
+			state = badStyle.Render("error: " + d.Error)
+		}
+		if len(d.Permissions) > 0 {
+			state += " " + warningStyle.Render("("+strings.Join(d.Permissions, ", ")+")")
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", d.Class, d.LocalPath, d.RepoPath, state)
+	}
+	w.Flush()
+}
+
+// Cobra status command — shows installed/missing packages and the state of each dotfile
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show which packages are installed and how dotfiles compare with the repo",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		status := getStatus()
+		if flagPresent(cmd, "json") {
+			b, err := json.MarshalIndent(status, "", "  ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(string(b))
+			return
+		}
+		printStatus(status)
+	},
+}
+
+func init() {
+	statusCmd.Flags().BoolP("json", "", false, "Output status as JSON")
+	rootCmd.AddCommand(statusCmd)
+}
@@ -0,0 +1,298 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Files at the top of a stow package that stow itself ignores by default
+var stowIgnored = regexp.MustCompile(`^(\.git|\.gitignore|\.gitmodules|\.stow-local-ignore|README.*|LICENSE.*|COPYING)$`)
+
+// A file in a stow package, and the sync target it becomes
+type stowFile struct {
+	class  string
+	source string // path of the file in the stow directory
+	target Target
+}
+
+// Turn a path in a stow package into a path relative to home, where stow's --dotfiles
+// convention writes leading dots as dot-
+func fromStowPath(rel string) string {
+	parts := strings.Split(rel, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, "dot-") {
+			parts[i] = "." + strings.TrimPrefix(p, "dot-")
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Turn a path relative to home into a path in a stow package, optionally using dot- for leading dots
+func toStowPath(rel string, dotfiles bool) string {
+	if !dotfiles {
+		return rel
+	}
+	parts := strings.Split(rel, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ".") {
+			parts[i] = "dot-" + strings.TrimPrefix(p, ".")
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Get a repo path for a file in a class, dropping leading dots so files aren't hidden in the repo
+// (e.g. .tmux.conf in the tmux package becomes tmux/tmux.conf)
+func stowRepoPath(class, rel string) string {
+	parts := strings.Split(rel, "/")
+	for i, p := range parts {
+		parts[i] = strings.TrimPrefix(p, ".")
+	}
+	return class + "/" + strings.Join(parts, "/")
+}
+
+// Find the files in each package of a stow directory, as sync targets. Each top-level directory is
+// a package, laid out as it should be in the home directory
+func stowFiles(dir string, packages []string) ([]stowFile, error) {
+	if len(packages) == 0 {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				packages = append(packages, e.Name())
+			}
+		}
+	}
+
+	var files []stowFile
+	for _, pkg := range packages {
+		if !bareKey.MatchString(pkg) {
+			return nil, fmt.Errorf("can't use package %q as a class: use letters, digits, - and _", pkg)
+		}
+		root := filepath.Join(dir, pkg)
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil || rel == "." {
+				return err
+			}
+			if !strings.Contains(rel, "/") && stowIgnored.MatchString(d.Name()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			home := fromStowPath(filepath.ToSlash(rel))
+			files = append(files, stowFile{pkg, p, Target{
+				Description: path.Base(home),
+				RepoPath:    stowRepoPath(pkg, home),
+				LocalPath:   "~/" + home,
+			}})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Cobra import-stow command — adds the files in a stow directory to config.toml as sync targets
+var importStowCmd = &cobra.Command{
+	Use:   "import-stow <dir>",
+	Short: "Add the packages in a GNU Stow directory as sync targets",
+	Long: "Copy the files in each package of a GNU Stow directory into the cloned repo, and add " +
+		"them to config.toml as sync targets, with a class per package. Files already managed are " +
+		"left alone. Names starting dot- (stow's --dotfiles convention) are read as dotfiles.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		repoDir := Config.repoDir(home)
+		packages, err := cmd.Flags().GetStringSlice("package")
+		if err != nil {
+			log.Fatal(err)
+		}
+		dryRun := flagPresent(cmd, "dry-run")
+
+		files, err := stowFiles(expandPath(args[0], home), packages)
+		if err != nil {
+			log.Fatal(err)
+		}
+		text, c, err := readRepoConfig(repoDir)
+		if err != nil {
+			log.Fatalf("Reading config.toml from %s: %s", repoDir, err)
+		}
+
+		// Skip files that are already managed
+		managed := map[string]bool{}
+		for _, s := range c.Sync {
+			for _, t := range s.Targets {
+				managed[expandPath(t.localPath(), home)] = true
+			}
+		}
+
+		// Work out everything to import before writing anything, so a clash doesn't leave the repo
+		// half updated. Files clash if they end up in the same place, in the repo or locally, or one
+		// would go inside the other
+		type importFile struct {
+			stowFile
+			content []byte
+		}
+		clash := func(a, b string) bool {
+			return within(a, b) || within(b, a)
+		}
+		var imports []importFile
+		for _, f := range files {
+			if managed[expandPath(f.target.LocalPath, home)] {
+				fmt.Printf("%s %s is already managed\n", skipMark, f.target.LocalPath)
+				continue
+			}
+			for _, other := range imports {
+				if clash(f.target.RepoPath, other.target.RepoPath) {
+					log.Fatalf("%s and %s clash in the repo as %s and %s", other.source, f.source, other.target.RepoPath, f.target.RepoPath)
+				}
+				if clash(f.target.LocalPath, other.target.LocalPath) {
+					log.Fatalf("%s and %s clash locally as %s and %s", other.source, f.source, other.target.LocalPath, f.target.LocalPath)
+				}
+			}
+
+			content, err := os.ReadFile(f.source)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if existing, err := os.ReadFile(repoDir + "/" + f.target.RepoPath); err == nil && !bytes.Equal(existing, content) {
+				log.Fatalf("%s already exists in the repo with different content", f.target.RepoPath)
+			}
+			imports = append(imports, importFile{f, content})
+		}
+
+		added := 0
+		for _, f := range imports {
+			if !dryRun {
+				info, err := os.Stat(f.source)
+				if err != nil {
+					log.Fatal(err)
+				}
+				repoFile := repoDir + "/" + f.target.RepoPath
+				if err := os.MkdirAll(filepath.Dir(repoFile), 0755); err != nil {
+					log.Fatal(err)
+				}
+				if err := os.WriteFile(repoFile, f.content, info.Mode().Perm()); err != nil {
+					log.Fatal(err)
+				}
+			}
+			text = addTargetToConfig(text, f.class, f.class, f.target)
+			added++
+			fmt.Printf("%s %s → %s in [sync.%s]\n", checkMark, f.target.LocalPath, f.target.RepoPath, f.class)
+		}
+
+		if added == 0 || dryRun {
+			return
+		}
+		if err := os.WriteFile(repoDir+"/config.toml", []byte(text), 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Added %d target(s) to %s/config.toml\n", added, repoDir)
+	},
+}
+
+// Cobra export-stow command — lays sync targets out as stow packages
+var exportStowCmd = &cobra.Command{
+	Use:   "export-stow <dir>",
+	Short: "Lay out sync targets as GNU Stow packages",
+	Long: "Write every sync target in config.toml into a GNU Stow directory, with a package per " +
+		"class, so `stow -t ~ <class>` puts it in place. Targets outside the home directory are " +
+		"skipped, as are blocks, since they share a file with other content. Files come from the " +
+		"cloned repo if there is one, otherwise from GitHub, and are written as they'd be put in " +
+		"place: decrypted, with templates rendered for this machine.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		dir := expandPath(args[0], home)
+		repoDir := Config.repoDir(home)
+		dotfiles := flagPresent(cmd, "dotfiles")
+		force := flagPresent(cmd, "force")
+
+		for _, t := range Config.SyncTargets() {
+			if !strings.HasPrefix(t.LocalPath, "~/") {
+				fmt.Printf("%s %s isn't in the home directory\n", skipMark, t.LocalPath)
+				continue
+			}
+			if t.strategy("", false) == strategyBlock {
+				fmt.Printf("%s %s is a block in %s, which stow can't share with other content\n", skipMark, t.RepoPath, t.LocalPath)
+				continue
+			}
+
+			// Prefer the cloned repo, so uncommitted changes come along
+			mode, dirMode := os.FileMode(0644), os.FileMode(0755)
+			content, err := os.ReadFile(repoDir + "/" + t.RepoPath)
+			if err == nil {
+				if info, err := os.Stat(repoDir + "/" + t.RepoPath); err == nil {
+					mode = info.Mode().Perm()
+				}
+			} else if content, err = fetch(Config.Metadata.BaseURL + t.RepoPath); err != nil {
+				log.Fatal(err)
+			}
+			if content, err = t.repoVersion(content, home); err != nil {
+				log.Fatal(err)
+			}
+
+			// Keep encrypted and private files private, as they would be once put in place
+			perms := t.permissions(expandPath(t.LocalPath, home), home)
+			if perms.mode != 0 {
+				mode = perms.mode
+			}
+			if perms.dirMode != 0 {
+				dirMode = perms.dirMode
+			}
+
+			dest := filepath.Join(dir, t.class, toStowPath(strings.TrimPrefix(t.LocalPath, "~/"), dotfiles))
+			if existing, err := os.ReadFile(dest); err == nil && !bytes.Equal(existing, content) && !force {
+				log.Fatalf("%s already exists with different content (use --force to overwrite)", dest)
+			}
+			if err := os.MkdirAll(filepath.Dir(dest), dirMode); err != nil {
+				log.Fatal(err)
+			}
+			if err := os.WriteFile(dest, content, mode); err != nil {
+				log.Fatal(err)
+			}
+			if err := os.Chmod(dest, mode); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%s %s → %s\n", checkMark, t.RepoPath, tildePath(dest, home))
+		}
+	},
+}
+
+func init() {
+	importStowCmd.Flags().StringSliceP("package", "p", nil, "Only import these packages")
+	importStowCmd.Flags().BoolP("dry-run", "n", false, "Show what would be imported without changing anything")
+	rootCmd.AddCommand(importStowCmd)
+
+	exportStowCmd.Flags().BoolP("dotfiles", "", false, "Write leading dots as dot-, for stow --dotfiles")
+	exportStowCmd.Flags().BoolP("force", "f", false, "Overwrite files that already exist")
+	rootCmd.AddCommand(exportStowCmd)
+}
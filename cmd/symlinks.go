@@ -0,0 +1,457 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// What happens, or happened, to a symlink
+type linkChange string
+
+const (
+	linkCreated   linkChange = "created"   // nothing was at the path
+	linkUpdated   linkChange = "updated"   // replaced a file, or a symlink pointing elsewhere
+	linkUnchanged linkChange = "unchanged" // already pointed at the right place
+	linkRemoved   linkChange = "removed"   // stale link taken away
+)
+
+// A symlink from a local path into the cloned repo, providing one or more sync targets. A link
+// provides several targets when their whole directory is folded into a single link
+type link struct {
+	path    string            // local path of the link
+	dest    string            // path in the cloned repo it points to
+	targets []Target          // targets it provides
+	folded  bool              // whether it links a whole directory
+	before  map[string][]byte // content of each target's local file when planned, by local path
+}
+
+// Get a link's path with the home directory shortened to ~, for messages
+func (l link) name(home string) string {
+	return tildePath(l.path, home)
+}
+
+// Get where a target the link provides ends up locally: in the folded directory, or at the link
+func (l link) targetPath(t Target, home string) string {
+	if l.folded {
+		return expandPath(t.LocalPath, home)
+	}
+	return l.path
+}
+
+// Whether links can replace local files that differ from the repo, set with --force
+var forceLinks bool
+
+// Work out what linking path to dest would change. Files that aren't links are only replaced if
+// they match the repo, unless forced
+func linkStatus(path, dest string) (linkChange, error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return linkCreated, nil
+	} else if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if current, err := os.Readlink(path); err == nil && current == dest {
+			return linkUnchanged, nil
+		}
+		return linkUpdated, nil
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", path)
+	}
+	if !forceLinks {
+		local, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		if repo, err := os.ReadFile(dest); err != nil || !bytes.Equal(local, repo) {
+			return "", fmt.Errorf("%s already exists with different content (use --force to overwrite)", path)
+		}
+	}
+	return linkUpdated, nil
+}
+
+// Point a symlink at dest, replacing whatever is at path in one step by renaming a new link over it
+func atomicSymlink(dest, path string) (linkChange, error) {
+	change, err := linkStatus(path, dest)
+	if err != nil || change == linkUnchanged {
+		return change, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.shell-config-%d", filepath.Base(path), os.Getpid()))
+	os.Remove(tmp)
+	if err := os.Symlink(dest, tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return change, nil
+}
+
+// Get the absolute destination of a symlink, or "" if path isn't one
+func linkDest(path string) string {
+	dest, err := os.Readlink(path)
+	if err != nil {
+		return ""
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(path), dest)
+	}
+	return dest
+}
+
+// Check if path is inside dir
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// Check if a local path resolves to a file in the cloned repo, directly or through a folded
+// directory
+func linkedToRepo(localPath, repoFile string) bool {
+	resolved, err := filepath.EvalSymlinks(localPath)
+	if err != nil {
+		return false
+	}
+	repoResolved, err := filepath.EvalSymlinks(repoFile)
+	return err == nil && resolved == repoResolved
+}
+
+// Replace a folded directory (a symlink to a directory in the repo) with a real one, so links
+// can be made inside it without writing into the repo
+func unfold(dir, repoDir string) error {
+	if !within(linkDest(dir), repoDir) {
+		return nil
+	}
+	if err := os.Remove(dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+///////////////////////////
+//     MANAGED LINKS     //
+///////////////////////////
+
+// Get the file listing the symlinks this tool has made, one path per line
+func managedLinksPath() string {
+	return filepath.Join(stateDir(), "links")
+}
+
+// Get the symlinks this tool has made
+func managedLinks() []string {
+	b, err := os.ReadFile(managedLinksPath())
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, p := range strings.Split(string(b), "\n") {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Add or remove a symlink from the list of those this tool has made
+func recordLink(path string, managed bool) error {
+	var paths []string
+	for _, p := range managedLinks() {
+		if p != path {
+			paths = append(paths, p)
+		}
+	}
+	if managed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(managedLinksPath(), []byte(strings.Join(paths, "\n")+"\n"), 0600)
+}
+
+///////////////////////////
+//       PLANNING        //
+///////////////////////////
+
+// Split a target into the directories its repo and local paths share a layout below, e.g.
+// gnupg/gpg.conf and ~/.gnupg/gpg.conf share gpg.conf below gnupg and ~/.gnupg
+func foldDirs(repoPath, localPath string) (string, string, bool) {
+	repoParts := strings.Split(repoPath, "/")
+	localParts := strings.Split(localPath, "/")
+	common := 0
+	for common < len(repoParts)-1 && common < len(localParts)-1 &&
+		repoParts[len(repoParts)-1-common] == localParts[len(localParts)-1-common] {
+		common++
+	}
+	if common == 0 {
+		return "", "", false
+	}
+	return strings.Join(repoParts[:len(repoParts)-common], "/"), strings.Join(localParts[:len(localParts)-common], "/"), true
+}
+
+// Check if every file in a repo directory is one of the given repo paths, so linking the whole
+// directory doesn't expose anything that isn't a target
+func onlyTargetsIn(repoDir string, repoPaths map[string]bool) bool {
+	for _, p := range Config.Metadata.GitPaths {
+		if !strings.HasPrefix(p, repoDir+"/") || repoPaths[p] {
+			continue
+		}
+		// Directories are listed too, and are fine as long as everything in them is a target
+		isDir := false
+		for _, q := range Config.Metadata.GitPaths {
+			if strings.HasPrefix(q, p+"/") {
+				isDir = true
+				break
+			}
+		}
+		if !isDir {
+			return false
+		}
+	}
+	return true
+}
+
+// Work out the symlinks needed for sync targets. Targets in classes with fold = true share a
+// single directory link when their directory holds nothing else and doesn't exist locally yet (or
+// is already folded), like GNU Stow; everything else gets a link per file
+func planLinks(targets []Target, home string) []link {
+	repoDir := Config.repoDir(home)
+	var links []link
+
+	// Group targets in folding classes by the directories they could be folded into
+	type fold struct{ repoDir, localDir string }
+	folds := map[fold][]Target{}
+	var order []fold
+	for _, t := range targets {
+		if !Config.Sync[t.class].Fold {
+			continue
+		}
+		r, l, ok := foldDirs(t.RepoPath, expandPath(t.LocalPath, home))
+		if !ok {
+			continue
+		}
+		f := fold{r, l}
+		if _, seen := folds[f]; !seen {
+			order = append(order, f)
+		}
+		folds[f] = append(folds[f], t)
+	}
+
+	folded := map[string]bool{}
+	for _, f := range order {
+		repoPaths := map[string]bool{}
+		for _, t := range folds[f] {
+			repoPaths[t.RepoPath] = true
+		}
+		dest := repoDir + "/" + f.repoDir
+		if _, err := os.Lstat(f.localDir); err == nil && linkDest(f.localDir) != dest {
+			continue
+		}
+		if !onlyTargetsIn(f.repoDir, repoPaths) {
+			continue
+		}
+		links = append(links, link{path: f.localDir, dest: dest, targets: folds[f], folded: true})
+		for p := range repoPaths {
+			folded[p] = true
+		}
+	}
+
+	for _, t := range targets {
+		if !folded[t.RepoPath] {
+			links = append(links, link{path: expandPath(t.LocalPath, home), dest: repoDir + "/" + t.RepoPath, targets: []Target{t}})
+		}
+	}
+
+	// Note the current content of each file so hooks can tell if it changed
+	for i := range links {
+		links[i].before = map[string][]byte{}
+		for _, t := range links[i].targets {
+			path := links[i].targetPath(t, home)
+			links[i].before[path], _ = os.ReadFile(path)
+		}
+	}
+
+	sort.SliceStable(links, func(i, j int) bool {
+		return strings.ToLower(links[i].path) < strings.ToLower(links[j].path)
+	})
+	return links
+}
+
+// Find symlinks into the cloned repo that should go: ones this tool made that are no longer
+// wanted, and broken ones next to wanted links
+func staleLinks(links []link, home string) []string {
+	repoDir := Config.repoDir(home)
+	wanted := map[string]bool{}
+	for _, l := range links {
+		wanted[l.path] = true
+	}
+	managed := map[string]bool{}
+	for _, p := range managedLinks() {
+		managed[p] = true
+	}
+
+	// Look at links we made, and everything in the directories links go in
+	candidates := map[string]bool{}
+	for p := range managed {
+		candidates[p] = true
+	}
+	for _, l := range links {
+		entries, _ := os.ReadDir(filepath.Dir(l.path))
+		for _, e := range entries {
+			if e.Type()&fs.ModeSymlink != 0 {
+				candidates[filepath.Join(filepath.Dir(l.path), e.Name())] = true
+			}
+		}
+	}
+
+	var stale []string
+	for p := range candidates {
+		dest := linkDest(p)
+		if wanted[p] || !within(dest, repoDir) {
+			continue
+		}
+		if _, err := os.Stat(dest); err != nil || managed[p] {
+			stale = append(stale, p)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+///////////////////////////
+//       APPLYING        //
+///////////////////////////
+
+// Create or update a link, running the hooks of the targets it provides if the link changes or the
+// content it resolves to differs from when it was planned
+func applyLink(l link, home string) (linkChange, error) {
+	change, err := linkStatus(l.path, l.dest)
+	if err != nil {
+		return "", err
+	}
+
+	// Only run pre hooks if we're about to touch the file
+	if change != linkUnchanged {
+		for _, t := range l.targets {
+			if err := t.runHooks(t.Pre, home); err != nil {
+				return "", err
+			}
+		}
+		if err := unfold(filepath.Dir(l.path), Config.repoDir(home)); err != nil {
+			return "", err
+		}
+		if change, err = atomicSymlink(l.dest, l.path); err != nil {
+			return "", err
+		}
+	}
+	if err := recordLink(l.path, true); err != nil {
+		return "", err
+	}
+
+	for _, t := range l.targets {
+		path := l.targetPath(t, home)
+		if err := applyPermissions(t, path, home); err != nil {
+			return "", err
+		}
+		after, _ := os.ReadFile(path)
+		if change != linkUnchanged || !bytes.Equal(l.before[path], after) {
+			if err := t.runHooks(t.Post, home); err != nil {
+				return "", err
+			}
+		}
+	}
+	return change, nil
+}
+
+// Remove a symlink this tool made, optionally putting a copy of what it pointed to in its place
+func removeLink(path string, restore bool) error {
+	dest := linkDest(path)
+	if dest == "" {
+		return recordLink(path, false)
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if restore {
+		if err := copyTree(dest, path); err != nil {
+			return err
+		}
+	}
+	return recordLink(path, false)
+}
+
+// Copy a file or directory tree, keeping file modes
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, content, info.Mode().Perm())
+	})
+}
+
+// Get actions linking sync targets into place and removing stale links
+func linkActions(targets []Target, home string) []action {
+	links := planLinks(targets, home)
+
+	var actions []action
+	for _, p := range staleLinks(links, home) {
+		actions = append(actions, action{
+			msg: fmt.Sprintf("Removing stale %s symlink", tildePath(p, home)),
+			fn:  func() error { return removeLink(p, false) },
+		})
+	}
+	for _, l := range links {
+		// Say what will change, going by how things look now
+		var msg string
+		switch change, err := linkStatus(l.path, l.dest); {
+		case err != nil:
+			msg = fmt.Sprintf("Linking %s (%s)", l.name(home), err)
+		case change == linkCreated:
+			msg = fmt.Sprintf("Creating %s symlink", l.name(home))
+		case change == linkUpdated:
+			msg = fmt.Sprintf("Updating %s symlink", l.name(home))
+		default:
+			msg = fmt.Sprintf("Checking %s symlink", l.name(home))
+		}
+		if l.folded {
+			msg += fmt.Sprintf(" (folded, %d files)", len(l.targets))
+		}
+		actions = append(actions, action{
+			msg: msg,
+			fn: func() error {
+				_, err := applyLink(l, home)
+				return err
+			},
+		})
+	}
+	return actions
+}
@@ -0,0 +1,358 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Ways of putting a target's file in place
+const (
+	strategySymlink  = "symlink"  // symlink to the file in the cloned repo
+	strategyCopy     = "copy"     // copy of the repo version
+	strategyHardlink = "hardlink" // hard link to the file in the cloned repo
+	strategyTemplate = "template" // copy of the repo version rendered as a template
+	strategyBlock    = "block"    // block of the repo version inside the local file
+)
+
+var strategies = []string{strategySymlink, strategyCopy, strategyHardlink, strategyTemplate, strategyBlock}
+
+// Work out how to put a target in place: its own strategy, then default_strategy, then the
+// fallback for the kind of install. Temporary installs can't link to a cloned repo, and encrypted
+// targets can't link to ciphertext, so they copy
+func (t Target) strategy(fallback string, tmp bool) string {
+	strategy := fallback
+	if t.Strategy != "" {
+		strategy = t.Strategy
+	} else if Config.DefaultStrategy != "" {
+		strategy = Config.DefaultStrategy
+	}
+	if (tmp || t.Encrypted) && (strategy == strategySymlink || strategy == strategyHardlink) {
+		return strategyCopy
+	}
+	return strategy
+}
+
+// Check if a strategy needs the cloned repo
+func needsClone(strategy string) bool {
+	return strategy == strategySymlink || strategy == strategyHardlink
+}
+
+// Get what a target's local file should contain given its repo content, decrypting it and
+// rendering templates
+func (t Target) repoVersion(content []byte, home string) ([]byte, error) {
+	content, err := t.plainContent(content)
+	if err != nil {
+		return nil, err
+	}
+	if t.strategy("", false) == strategyTemplate {
+		return renderTemplate(t.RepoPath, content, home)
+	}
+	return content, nil
+}
+
+// Get the files a directory target mirrors, as targets of their own. Only files matching an
+// include pattern (if there are any) and no exclude pattern are kept
+func (t Target) files() []Target {
+	return t.filesIn(Config.Metadata)
+}
+
+// Get the files a directory target mirrors, going by the paths in the given repo metadata
+func (t Target) filesIn(m metadata) []Target {
+	var files []Target
+	for _, p := range m.GitPaths {
+		if !strings.HasPrefix(p, t.RepoPath+"/") || m.isDir(p) {
+			continue
+		}
+		rel := strings.TrimPrefix(p, t.RepoPath+"/")
+		included := len(t.Include) == 0
+		for _, pattern := range t.Include {
+			included = included || matchRelative(pattern, rel)
+		}
+		for _, pattern := range t.Exclude {
+			included = included && !matchRelative(pattern, rel)
+		}
+		if included {
+			f := t
+			f.parent = t.RepoPath
+			f.RepoPath = p
+			f.LocalPath = t.LocalPath + "/" + rel
+			f.Include, f.Exclude, f.Prune = nil, nil, false
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// Get the files a target covers: the files in it if it's a directory, otherwise just itself
+func (t Target) expand() []Target {
+	return t.expandIn(Config.Metadata)
+}
+
+// Get the files a target covers, going by the paths in the given repo metadata
+func (t Target) expandIn(m metadata) []Target {
+	if m.isDir(t.RepoPath) {
+		return t.filesIn(m)
+	}
+	return []Target{t}
+}
+
+// Remove files from a directory target's local copy that were saved before but are no longer in
+// the repo (or no longer included), unless they've been edited since. Returns the removed paths
+func pruneTarget(t Target, home string) ([]string, error) {
+	wanted := map[string]bool{}
+	for _, f := range t.files() {
+		wanted[expandPath(f.LocalPath, home)] = true
+	}
+
+	var removed []string
+	err := filepath.WalkDir(expandPath(t.LocalPath, home), func(p string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil || !d.Type().IsRegular() || wanted[p] {
+			return err
+		}
+
+		// Only remove files we saved and that haven't changed since
+		base, ok := readBase(p)
+		if !ok {
+			return nil
+		}
+		content, err := os.ReadFile(p)
+		if err != nil || !bytes.Equal(content, base) {
+			return err
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		removed = append(removed, p)
+		return os.Remove(basePath(p))
+	})
+	return removed, err
+}
+
+// Run hook steps in order, stopping at the first failure that isn't ignored
+func runSteps(steps []Step, home string, env map[string]string) error {
+	for _, s := range steps {
+		// Add env to the step's own variables, without changing the step
+		a := s.action(home)
+		a.env = map[string]string{}
+		for k, v := range env {
+			a.env[k] = v
+		}
+		for k, v := range s.Env {
+			a.env[k] = v
+		}
+		run, err := a.shouldRun()
+		if err == nil && run {
+			err = a.execute()
+		}
+		if err != nil && !a.ignoreErrors {
+			return fmt.Errorf("%s: %w", a.msg, err)
+		}
+	}
+	return nil
+}
+
+// Run a target's hooks, with TARGET_PATH set to where its local file is
+func (t Target) runHooks(steps []Step, home string) error {
+	return runSteps(steps, home, map[string]string{"TARGET_PATH": expandPath(t.LocalPath, home)})
+}
+
+// Write content to a target's local path, running the target's hooks only if the file changes.
+// If the local file was edited since it was last saved, local and repo changes are merged, and
+// conflicts left in it are returned as an error so they get noticed
+func saveTarget(t Target, localPath string, upstream []byte, home string) error {
+	content := upstream
+	markers := false
+	existing, err := os.ReadFile(localPath)
+	if err == nil && !bytes.Equal(existing, upstream) {
+		content, markers, err = reconcile(t, localPath, existing, upstream)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Nothing to do if the file is already up to date, or local changes are being kept
+	if content == nil || bytes.Equal(existing, content) {
+		return writeBase(localPath, upstream)
+	}
+
+	if err := t.runHooks(t.Pre, home); err != nil {
+		return err
+	}
+	perms := t.permissions(localPath, home)
+	dirMode, mode := os.FileMode(0755), os.FileMode(0644)
+	if perms.dirMode != 0 {
+		dirMode = perms.dirMode
+	}
+	if perms.mode != 0 {
+		mode = perms.mode
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), dirMode); err != nil {
+		return err
+	}
+	if err := os.WriteFile(localPath, content, mode); err != nil {
+		return err
+	}
+	if err := writeBase(localPath, upstream); err != nil {
+		return err
+	}
+	if markers {
+		return fmt.Errorf("%s changed both locally and in the repo, fix the conflict markers in it and run again", tildePath(localPath, expandHome("~")))
+	}
+	return t.runHooks(t.Post, home)
+}
+
+// Hard link a target's local path to a file in the cloned repo, replacing whatever is there in one
+// step, and running the target's hooks if the link or the content it has changes
+func hardlinkTarget(t Target, localPath, repoFile string, before []byte, home string) error {
+	linkChanged := !sameFile(localPath, repoFile)
+	if linkChanged {
+		if err := t.runHooks(t.Pre, home); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		tmp := filepath.Join(filepath.Dir(localPath), fmt.Sprintf(".%s.shell-config-%d", filepath.Base(localPath), os.Getpid()))
+		os.Remove(tmp)
+		if err := os.Link(repoFile, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, localPath); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	after, _ := os.ReadFile(localPath)
+	if linkChanged || !bytes.Equal(before, after) {
+		return t.runHooks(t.Post, home)
+	}
+	return nil
+}
+
+// Put a target's file in place at localPath with a strategy. Links point at repoFile in the cloned
+// repo, while copies and templates use the repo version from content, called when needed. before
+// is the local file's content when the install was planned
+func placeTarget(t Target, localPath, strategy, repoFile string, before []byte, content func() ([]byte, error), home string) error {
+	switch strategy {
+	case strategySymlink:
+		_, err := applyLink(link{path: localPath, dest: repoFile, targets: []Target{t}, before: map[string][]byte{localPath: before}}, home)
+		return err
+	case strategyHardlink:
+		if err := hardlinkTarget(t, localPath, repoFile, before, home); err != nil {
+			return err
+		}
+		return applyPermissions(t, localPath, home)
+	}
+
+	b, err := content()
+	if err == nil {
+		b, err = t.plainContent(b)
+	}
+	if err != nil {
+		return err
+	}
+	switch strategy {
+	case strategyTemplate:
+		if b, err = renderTemplate(t.RepoPath, b, home); err != nil {
+			return err
+		}
+	case strategyBlock:
+		if err := blockTarget(t, localPath, b, home); err != nil {
+			return err
+		}
+		return applyPermissions(t, localPath, home)
+	}
+	if err := saveTarget(t, localPath, b, home); err != nil {
+		return err
+	}
+	return applyPermissions(t, localPath, home)
+}
+
+// State of a target's local file compared with the repo
+type targetState string
+
+const (
+	stateLinked    targetState = "linked"    // symlink (maybe via a folded directory) or hard link to the cloned repo
+	stateIdentical targetState = "identical" // copy with the same content as the repo
+	stateModified  targetState = "modified"  // copy whose content differs from the repo
+	stateMissing   targetState = "missing"   // nothing at the local path
+	stateConflict  targetState = "conflict"  // something else, like a symlink elsewhere or a directory
+)
+
+// Work out the state of a target's local file, given its content in the repo
+func inspectTarget(t Target, home string, repoContent []byte) (targetState, error) {
+	localPath := expandPath(t.LocalPath, home)
+	info, err := os.Lstat(localPath)
+	if os.IsNotExist(err) {
+		return stateMissing, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	repoFile := Config.repoDir(home) + "/" + t.RepoPath
+	switch {
+	case linkedToRepo(localPath, repoFile):
+		return stateLinked, nil
+	case info.Mode().IsRegular() && sameFile(localPath, repoFile):
+		return stateLinked, nil
+	case info.Mode()&os.ModeSymlink != 0, !info.Mode().IsRegular():
+		return stateConflict, nil
+	}
+
+	content, err := os.ReadFile(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	// Blocks only cover part of the file
+	if t.strategy("", false) == strategyBlock {
+		var found bool
+		if content, found = t.extractBlock(content); !found {
+			return stateMissing, nil
+		}
+	}
+	if bytes.Equal(content, repoContent) {
+		return stateIdentical, nil
+	}
+	return stateModified, nil
+}
+
+// Check if two paths are the same file, e.g. hard links to each other
+func sameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	return err == nil && os.SameFile(infoA, infoB)
+}
+
+// Select host targets by class name, repo path (or that of their directory) or local path, or all of them if none are given
+func selectTargets(args []string) ([]Target, error) {
+	targets := Config.hostTargets()
+	if len(args) == 0 {
+		return targets, nil
+	}
+
+	var selected []Target
+	for _, arg := range args {
+		found := false
+		for _, t := range targets {
+			if arg == t.class || arg == t.RepoPath || arg == t.parent || expandHome(arg) == expandHome(t.LocalPath) {
+				selected = append(selected, t)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no sync target matches %q", arg)
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// Dotfiles with strategy = "template" are Go text/template files, rendered on each machine with
+// the same variables and functions as conditions, plus home, e.g.
+//
+//	{{ if eq .os "darwin" }}export BROWSER=open{{ end }}
+//	{{ if command_exists "nvim" }}export EDITOR=nvim{{ end }}
+
+// Render a template file from the repo for this machine
+func renderTemplate(name string, content []byte, home string) ([]byte, error) {
+	funcs := template.FuncMap{}
+	for name, f := range conditionFunctions {
+		funcs[name] = f
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{"home": home}
+	for name, v := range conditionVariables {
+		data[name] = v()
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
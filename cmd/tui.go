@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/list"
 	"github.com/charmbracelet/bubbles/spinner"
 	tea "github.com/charmbracelet/bubbletea"
@@ -23,22 +26,32 @@ var (
 	quitTextStyle      = lipgloss.NewStyle().Margin(1, 0, 2, 4).Bold(true)
 	currentActionStyle = lipgloss.NewStyle().Bold(true)
 	checkMark          = lipgloss.NewStyle().Foreground(lipgloss.Color("42")).SetString("✓")
+	skipMark           = lipgloss.NewStyle().Foreground(lipgloss.Color("241")).SetString("-")
+	crossMark          = lipgloss.NewStyle().Foreground(lipgloss.Color("196")).SetString("✗")
+	errorStyle         = lipgloss.NewStyle().Margin(1, 0, 2, 4).Foreground(lipgloss.Color("196"))
+	detailStyle        = lipgloss.NewStyle().PaddingLeft(8).Foreground(lipgloss.Color("241"))
 )
 
-// Store shell command to run and the name to display when running it
-type action struct {
-	msg     string
-	command string
+// List item: the full config, an installer (maybe temporary) or a package group
+type item struct {
+	title    string
+	full     bool
+	flag     string   // installer flag
+	tmp      bool     // temporary install of the installer
+	group    string   // package group
+	packages []string // packages chosen from the group, or nil for all of them
 }
 
-// List item
-type item string
-
 // FilterValue is required by the list.Item interface.
 func (i item) FilterValue() string { return "" }
 
-// itemDelegate is required by the list.Model interface.
-type itemDelegate struct{}
+// itemDelegate is required by the list.Model interface. It shows which items are checked, and how
+// many packages are chosen from groups, going by the model's maps (which are shared, so they stay
+// in sync)
+type itemDelegate struct {
+	checked map[int]bool
+	chosen  map[string][]string
+}
 
 func (d itemDelegate) Height() int                               { return 1 }
 func (d itemDelegate) Spacing() int                              { return 0 }
@@ -50,7 +63,14 @@ func (d itemDelegate) Render(w io.Writer, m list.Model, index int, listItem list
 		return
 	}
 
-	str := fmt.Sprintf("%d. %s", index+1, i)
+	mark := "[ ]"
+	if d.checked[index] {
+		mark = "[x]"
+	}
+	str := fmt.Sprintf("%d. %s %s", index+1, mark, i.title)
+	if chosen, ok := d.chosen[i.group]; ok {
+		str += fmt.Sprintf(" (%d of %d)", len(chosen), len(PM.groupPackages(i.group)))
+	}
 
 	fn := itemStyle.Render
 	if index == m.Index() {
@@ -65,12 +85,19 @@ func (d itemDelegate) Render(w io.Writer, m list.Model, index int, listItem list
 // Bubble Tea model
 type model struct {
 	list             list.Model
+	checked          map[int]bool
+	chosen           map[string][]string // packages chosen in groups, where not all of them
+	packages         *packageChooser     // set while choosing packages in a group
 	actions          []action
 	index            int
 	spinner          spinner.Model
 	firstFlagInstall bool
 	done             bool
 	quitting         bool
+	lastMark         string
+	conflict         *conflictMsg
+	failedPackages   []string // packages that didn't install, which don't stop the run
+	err              error
 }
 
 // Initialize the model
@@ -80,6 +107,11 @@ func (m model) Init() tea.Cmd {
 
 // Update the model when a message is received
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	// Packages in a group are chosen before anything runs
+	if m.packages != nil {
+		return updatePackages(msg, m)
+	}
+
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		switch keypress := msg.String(); keypress {
@@ -89,11 +121,16 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 	}
 
+	// If an action is waiting on a conflict, resolve it first
+	if m.conflict != nil {
+		return updateConflict(msg, m)
+	}
+
 	// If actions are present, run them
-	if len(m.actions) > 1 {
+	if len(m.actions) > 0 {
 		if m.firstFlagInstall {
 			m.firstFlagInstall = false
-			return m, tea.Batch(runAction(m.actions[m.index]), m.spinner.Tick)
+			return m, m.start()
 		}
 		return updateChosen(msg, m)
 	}
@@ -108,37 +145,35 @@ func updateChoices(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
 		m.list.SetWidth(msg.Width)
 		return m, nil
 	case tea.KeyMsg:
-		if msg.String() == "enter" {
-			// Get the selected item and add the corresponding actions to the queue
-			i, ok := m.list.SelectedItem().(item)
-			if ok {
-				if string(i) == "Full shell config" {
-					m.actions = append(m.actions, fullConfig()...)
-				} else if strings.Contains(string(i), "packages") {
-					// Add package manager update action
-					m.actions = append(m.actions, action{"Updating package manager", PM.commands.updateCmd})
-					// Add packages actions
-					packageGroup := strings.ReplaceAll(string(i), " packages", "")
-					m.actions = append(m.actions, PM.packageInstallActions(packageGroup)...)
-				} else {
-					// Iterate through installers to find a match and add the corresponding actions
-					for flag, v := range Config.Installers {
-						// Get temporary install message
-						hm := strings.Fields(v.HelpMessage)
-						tmpItemMsg := "Temporarily " + strings.ToLower(hm[0]) + " " + strings.Join(hm[1:], " ")
-
-						if string(i) == v.HelpMessage {
-							// Normal install
-							m.actions = append(m.actions, install(flag, false)...)
-						} else if string(i) == tmpItemMsg {
-							// Temporary install
-							m.actions = append(m.actions, install(flag, true)...)
-						}
-					}
+		switch msg.String() {
+		case " ":
+			// Toggle the current item
+			m.checked[m.list.Index()] = !m.checked[m.list.Index()]
+			return m, nil
+		case "tab":
+			// Choose packages in the current group
+			if i, ok := m.list.SelectedItem().(item); ok && i.group != "" {
+				m.packages = newPackageChooser(i.group, m.chosen[i.group], m.list.Width(), m.list.Index())
+			}
+			return m, nil
+		case "enter":
+			// Install the checked items, or the current one if none are checked
+			var choices []item
+			for index, listItem := range m.list.Items() {
+				if i, ok := listItem.(item); ok && m.checked[index] {
+					i.packages = m.chosen[i.group]
+					choices = append(choices, i)
 				}
-				return m, tea.Batch(runAction(m.actions[m.index]), m.spinner.Tick)
 			}
-			return m, tea.Quit
+			if i, ok := m.list.SelectedItem().(item); ok && len(choices) == 0 {
+				i.packages = m.chosen[i.group]
+				choices = append(choices, i)
+			}
+			m.actions = planActions(choices)
+			if len(m.actions) == 0 {
+				return m, tea.Quit
+			}
+			return m, m.start()
 		}
 	}
 	var cmd tea.Cmd
@@ -146,17 +181,176 @@ func updateChoices(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
+// A package in a group, as shown when choosing packages
+type packageItem struct {
+	name        string
+	description string
+	url         string
+	system      string // how it's installed here, e.g. "bat via apt"
+	status      string // installed (with version), or not
+}
+
+// FilterValue is required by the list.Item interface.
+func (p packageItem) FilterValue() string { return p.name }
+
+// packageDelegate shows packages with whether they're checked, and their details below
+type packageDelegate struct {
+	checked map[int]bool
+}
+
+func (d packageDelegate) Height() int                               { return 2 }
+func (d packageDelegate) Spacing() int                              { return 0 }
+func (d packageDelegate) Update(msg tea.Msg, m *list.Model) tea.Cmd { return nil }
+func (d packageDelegate) Render(w io.Writer, m list.Model, index int, listItem list.Item) {
+	p, ok := listItem.(packageItem)
+	if !ok {
+		return
+	}
+
+	mark := "[ ]"
+	if d.checked[index] {
+		mark = "[x]"
+	}
+	str := fmt.Sprintf("%s %s (%s, %s)", mark, p.name, p.system, p.status)
+
+	fn := itemStyle.Render
+	if index == m.Index() {
+		fn = func(s ...string) string {
+			return selectedItemStyle.Render("> " + strings.Join(s, ""))
+		}
+	}
+	details := strings.TrimSpace(p.description + " " + p.url)
+	fmt.Fprint(w, fn(str)+"\n"+detailStyle.Render(details))
+}
+
+// Packages of a group being chosen in the TUI, and the index of the group in the list of choices
+type packageChooser struct {
+	group   string
+	index   int
+	list    list.Model
+	checked map[int]bool
+}
+
+// Set up choosing packages in a group, starting with those chosen before (or all of them)
+func newPackageChooser(group string, chosen []string, width, index int) *packageChooser {
+	c := &packageChooser{group: group, index: index, checked: map[int]bool{}}
+	var items []list.Item
+	for n, name := range PM.groupPackages(group) {
+		pack := PM.Packages.PackageByName(name)
+		p := packageItem{name: name, description: pack["description"], url: pack["url"], status: "not installed"}
+		if r, ok := PM.resolve(name); !ok {
+			p.system = "no package for " + PM.managerNames()
+		} else if r.manager == nil {
+			p.system = "via install command"
+		} else {
+			p.system = r.system + " via " + r.via()
+		}
+		if installed, version := PM.installedVersion(name); installed {
+			p.status = strings.TrimSpace("installed " + version)
+		}
+		items = append(items, p)
+		c.checked[n] = chosen == nil || contains(chosen, name)
+	}
+
+	c.list = list.New(items, packageDelegate{c.checked}, width, 2*len(items)+6)
+	c.list.Title = group + " packages"
+	c.list.SetShowStatusBar(false)
+	c.list.SetFilteringEnabled(false)
+	c.list.Styles.Title = titleStyle
+	c.list.Styles.PaginationStyle = paginationStyle
+	c.list.Styles.HelpStyle = helpStyle
+	c.list.AdditionalShortHelpKeys = func() []key.Binding {
+		return []key.Binding{
+			key.NewBinding(key.WithKeys(" "), key.WithHelp("space", "toggle")),
+			key.NewBinding(key.WithKeys("enter", "esc"), key.WithHelp("enter", "done")),
+		}
+	}
+	return c
+}
+
+// Handle user input while choosing packages in a group. Going back checks the group if any of its
+// packages are chosen
+func updatePackages(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
+	c := m.packages
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		c.list.SetWidth(msg.Width)
+		m.list.SetWidth(msg.Width)
+		return m, nil
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "ctrl+c", "q":
+			m.quitting = true
+			return m, tea.Quit
+		case " ":
+			c.checked[c.list.Index()] = !c.checked[c.list.Index()]
+			return m, nil
+		case "enter", "esc":
+			chosen := []string{}
+			for n, listItem := range c.list.Items() {
+				if p, ok := listItem.(packageItem); ok && c.checked[n] {
+					chosen = append(chosen, p.name)
+				}
+			}
+			// Choosing everything is the same as the whole group, and choosing nothing unchecks it
+			if len(chosen) == 0 || len(chosen) == len(c.list.Items()) {
+				delete(m.chosen, c.group)
+			} else {
+				m.chosen[c.group] = chosen
+			}
+			m.checked[c.index] = len(chosen) > 0
+			m.packages = nil
+			return m, nil
+		}
+	}
+	var cmd tea.Cmd
+	c.list, cmd = c.list.Update(msg)
+	return m, cmd
+}
+
+// Start running the queued actions, asking for sudo credentials first if any action needs them
+func (m model) start() tea.Cmd {
+	if needsSudo(m.actions) {
+		return tea.ExecProcess(exec.Command("sudo", "-v"), func(err error) tea.Msg {
+			if err != nil {
+				return failedActionMsg{"Authenticating with sudo", err}
+			}
+			return sudoReadyMsg{}
+		})
+	}
+	return tea.Batch(runAction(m.actions[m.index]), m.spinner.Tick)
+}
+
 // Run the next action in the queue
 func updateChosen(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
+	case sudoReadyMsg:
+		return m, tea.Batch(runAction(m.actions[m.index]), m.spinner.Tick)
+	case failedActionMsg:
+		m.err = fmt.Errorf("%s failed: %w", msg.msg, msg.err)
+		return m, tea.Quit
+	case conflictMsg:
+		m.conflict = &msg
+		return m, nil
 	case completedActionsMsg:
+		// Show how the previous action finished. Ignored errors, including ones in when/unless
+		// conditions, still get a cross rather than looking like a condition that wasn't met
+		m.lastMark = checkMark.String()
+		if msg.err != nil {
+			m.lastMark = crossMark.String()
+			if pkg := m.actions[m.index].pkg; pkg != "" {
+				m.failedPackages = append(m.failedPackages, pkg)
+			}
+		} else if msg.skipped {
+			m.lastMark = skipMark.String()
+		}
 		m.index++
 		if m.index >= len(m.actions) {
 			m.done = true
 			return m, tea.Quit
 		}
 		return m, tea.Batch(
-			tea.Printf(fmt.Sprintf("%s %s", checkMark, m.actions[m.index-1].msg)),
+			tea.Println(m.lastMark+" "+m.actions[m.index-1].msg),
 			runAction(m.actions[m.index]),
 		)
 	case spinner.TickMsg:
@@ -167,17 +361,51 @@ func updateChosen(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// Handle the user's choice of how to resolve a conflict
+func updateConflict(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		choices := map[string]conflictPolicy{"m": conflictMarkers, "l": conflictLocal, "u": conflictUpstream}
+		if policy, ok := choices[msg.String()]; ok {
+			m.conflict.reply <- policy
+			m.conflict = nil
+		}
+	case spinner.TickMsg:
+		var cmd tea.Cmd
+		m.spinner, cmd = m.spinner.Update(msg)
+		return m, cmd
+	}
+	return m, nil
+}
+
 // Change view based on model status
 func (m model) View() string {
 	if m.quitting {
 		return quitTextStyle.Render("Cancelling configuration 😔")
 	}
-	if len(m.actions) > 1 {
+	if m.err != nil {
+		return errorStyle.Render(m.err.Error())
+	}
+	if m.conflict != nil {
+		return conflictView(m)
+	}
+	if m.packages != nil {
+		return "\n" + m.packages.list.View()
+	}
+	if len(m.actions) > 0 {
 		return chosenView(m)
 	}
 	return choicesView(m)
 }
 
+// View for a conflict waiting to be resolved
+func conflictView(m model) string {
+	title := currentActionStyle.Render(fmt.Sprintf("Both %s and the repo changed since it was last saved", m.conflict.localPath))
+	hunks := conflictHunks(m.conflict.merged, 20)
+	keys := helpStyle.Render("m: write conflict markers • l: keep local file • u: use repo version")
+	return fmt.Sprintf("%s\n\n%s\n\n%s", title, hunks, keys)
+}
+
 // View for the list of choices
 func choicesView(m model) string {
 	return "\n" + m.list.View()
@@ -186,132 +414,188 @@ func choicesView(m model) string {
 // View for the current action
 func chosenView(m model) string {
 	if m.done {
-		lastPackageComplete := fmt.Sprintf("%s %s\n", checkMark, m.actions[m.index-1].msg)
+		lastPackageComplete := fmt.Sprintf("%s %s\n", m.lastMark, m.actions[m.index-1].msg)
+		if len(m.failedPackages) > 0 {
+			summary := fmt.Sprintf("Finished, but %d package(s) failed to install: %s", len(m.failedPackages), strings.Join(m.failedPackages, ", "))
+			return lastPackageComplete + errorStyle.Render(summary)
+		}
 		return lastPackageComplete + quitTextStyle.Render("All tasks complete 😊")
 	}
 	info := currentActionStyle.Render(m.actions[m.index].msg)
 	return fmt.Sprintf("%s%s (%d/%d)", m.spinner.View(), info, m.index+1, len(m.actions))
 }
 
-type completedActionsMsg string
+// Messages sent when an action finishes
+type (
+	completedActionsMsg struct {
+		msg     string
+		skipped bool
+		err     error
+	}
+
+	failedActionMsg struct {
+		msg string
+		err error
+	}
+
+	sudoReadyMsg struct{}
+)
 
 // Run a command and return a message when it's done
 func runAction(a action) tea.Cmd {
 	return tea.Tick(time.Millisecond*0, func(t time.Time) tea.Msg {
-		runCommand(a.command)
-		return completedActionsMsg(a.msg)
+		// Actions with nothing to run, like notes about packages that can't be installed, are skipped
+		if a.command == "" && a.fn == nil {
+			return completedActionsMsg{a.msg, true, nil}
+		}
+
+		// Skip actions whose conditions aren't met
+		run, err := a.shouldRun()
+		if err == nil && run {
+			err = a.execute()
+		}
+		if err != nil && !a.ignoreErrors {
+			return failedActionMsg{a.msg, err}
+		}
+		return completedActionsMsg{a.msg, !run, err}
 	})
 }
 
-// Run the TUI
-func tui(tuiOptions map[string]bool) {
-	// Spinner style
-	s := spinner.New()
-	s.Spinner = spinner.Dot
-	s.Style = lipgloss.NewStyle().Bold(true)
+// Get everything that can be installed: the full config, then installers, temporary installers
+// and package groups, each sorted by name irrespective of case
+func choiceItems() []item {
+	var installers, temporaryInstallers, packageGroups []item
+	for flag, v := range Config.Installers {
+		installers = append(installers, item{title: v.HelpMessage, flag: flag})
 
-	// List of actions
-	actions := []action{}
-
-	// Parse flags
-	if tuiOptions["full"] {
-		// Full config
-		actions = append(actions, fullConfig()...)
-	} else {
-		tmp := tuiOptions["tmp"]
-		for flag, present := range tuiOptions {
-			// Ignore tmp flag, as we already recorded its value
-			if flag == "tmp" {
-				continue
-			}
-			// If flag is present, add the corresponding actions
-			if present {
-				actions = append(actions, install(flag, tmp)...)
-			}
-		}
+		// Create temporary help message
+		hm := strings.Fields(v.HelpMessage)
+		message := "Temporarily " + strings.ToLower(hm[0]) + " " + strings.Join(hm[1:], " ")
+		temporaryInstallers = append(temporaryInstallers, item{title: message, flag: flag, tmp: true})
+	}
+	for packageGroup := range PM.Packages {
+		packageGroups = append(packageGroups, item{title: packageGroup + " packages", group: packageGroup})
+	}
 
-		// Remove duplicate actions and (if necessary) consolidate uninstall script
-		exportActions := []action{}
-		executedCommands := []string{}
-		uninstallCommmads := []string{}
-		for _, a := range actions {
-			if a.msg == "Adding uninstall script" {
-				uninstallCommmads = append(uninstallCommmads, a.command)
-				continue
-			}
-			if !contains(executedCommands, a.command) {
-				exportActions = append(exportActions, a)
-				executedCommands = append(executedCommands, a.command)
-			}
-		}
+	items := []item{{title: "Full shell config", full: true}}
+	for _, group := range [][]item{installers, temporaryInstallers, packageGroups} {
+		sort.Slice(group, func(i, j int) bool {
+			return strings.ToLower(group[i].title) < strings.ToLower(group[j].title)
+		})
+		items = append(items, group...)
+	}
+	return items
+}
 
-		var uninstallPath string
-		var uninstallCommands []string
-		if len(uninstallCommmads) > 1 {
-			for _, u := range uninstallCommmads {
-				ss := strings.Split(u, "'")
-				uninstallPath = ss[len(ss)-1][3:]
-				uc := strings.Split(ss[1], "; ")
-				uninstallCommands = append(uninstallCommands, uc[:len(uc)-1]...)
-			}
-			uninstallAction := fmt.Sprintf("echo '%s; rm -rf %s' > %s", strings.Join(uninstallCommands, "; "), parentDir(uninstallPath), uninstallPath)
-			exportActions = append(exportActions, action{"Adding uninstall script", uninstallAction})
-		} else if len(uninstallCommands) > 0 {
-			exportActions = append(exportActions, action{"Adding uninstall script", uninstallCommmads[0]})
+// Merge the actions for any combination of choices into one plan: the full config, then the
+// packages from all chosen groups installed together, then installers. Actions shared between
+// choices (like updating a package manager) only run once
+func planActions(choices []item) []action {
+	var full, installers []action
+	var packages, installerInstalls []string
+	tmp := false
+	for _, c := range choices {
+		switch {
+		case c.full:
+			full = fullConfig()
+		case c.group != "" && c.packages != nil:
+			packages = append(packages, c.packages...)
+		case c.group != "":
+			packages = append(packages, PM.groupPackages(c.group)...)
+		case c.flag != "":
+			installers = append(installers, install(c.flag, c.tmp)...)
+			installerInstalls = append(installerInstalls, installerPackages(c.flag, c.tmp)...)
+			tmp = tmp || c.tmp
 		}
-
-		actions = exportActions
 	}
 
-	// No options passed, launch the TUI list selector
-	items := []list.Item{item("Full shell config")}
+	// The full config already installs every package group
+	actions := full
+	if len(packages) > 0 && full == nil {
+		actions = append(actions, PM.updateActions(packages)...)
 
-	// Add installers to the list
-	var installers []string
-	for _, v := range Config.Installers {
-		installers = append(installers, v.HelpMessage)
+		// Packages chosen installers install themselves are left to them
+		var batched []string
+		for _, name := range packages {
+			if !contains(installerInstalls, name) {
+				batched = append(batched, name)
+			}
+		}
+		actions = append(actions, PM.packageInstallActions(batched)...)
 	}
-	for _, i := range Sorted(installers) {
-		items = append(items, item(i))
+	actions = append(actions, installers...)
+
+	// Remove duplicate actions
+	var planned []action
+	var keys []string
+	for _, a := range actions {
+		if key := a.key(); key == "" || !contains(keys, key) {
+			planned = append(planned, a)
+			keys = append(keys, key)
+		}
 	}
-
-	// Add temporary installers to the list
-	var temporaryInstallers []string
-	for _, v := range Config.Installers {
-		// Create temporary help message and append to items
-		hm := strings.Fields(v.HelpMessage)
-		message := "Temporarily " + strings.ToLower(hm[0]) + " " + strings.Join(hm[1:], " ")
-		temporaryInstallers = append(temporaryInstallers, message)
+	if len(planned) == 0 {
+		return nil
 	}
-	for _, ti := range Sorted(temporaryInstallers) {
-		items = append(items, item(ti))
+
+	// Point programs at the saved dotfiles once they're all in place
+	if tmp {
+		planned = append(planned, activateAction(tmpDir()))
 	}
+	return withRunHooks(planned)
+}
 
-	// Add package groups to the list, sorted by name irrespective of case
-	var packageGroups []string
-	for packageGroup := range PM.Packages {
-		packageGroups = append(packageGroups, packageGroup)
+// Run the TUI
+func tui(tuiOptions map[string]bool) {
+	// Spinner style
+	s := spinner.New()
+	s.Spinner = spinner.Dot
+	s.Style = lipgloss.NewStyle().Bold(true)
+
+	// Plan the installs chosen with flags, if any
+	items := choiceItems()
+	var choices []item
+	for _, i := range items {
+		if i.full && tuiOptions["full"] || i.flag != "" && tuiOptions[i.flag] && i.tmp == tuiOptions["tmp"] {
+			choices = append(choices, i)
+		}
 	}
+	actions := planActions(choices)
 
-	for _, packageGroup := range Sorted(packageGroups) {
-		items = append(items, item(packageGroup+" packages"))
+	// Otherwise, launch the TUI checklist
+	var listItems []list.Item
+	for _, i := range items {
+		listItems = append(listItems, i)
 	}
 
 	// Setup list
-	l := list.New(items, itemDelegate{}, 25, len(items)+6)
+	checked, chosen := map[int]bool{}, map[string][]string{}
+	l := list.New(listItems, itemDelegate{checked, chosen}, 25, len(listItems)+6)
 	l.Title = "Hi 👋 Let's set up your shell"
 	l.SetShowStatusBar(false)
 	l.SetFilteringEnabled(false)
 	l.Styles.Title = titleStyle
 	l.Styles.PaginationStyle = paginationStyle
 	l.Styles.HelpStyle = helpStyle
+	l.AdditionalShortHelpKeys = func() []key.Binding {
+		return []key.Binding{
+			key.NewBinding(key.WithKeys(" "), key.WithHelp("space", "toggle")),
+			key.NewBinding(key.WithKeys("tab"), key.WithHelp("tab", "choose packages")),
+			key.NewBinding(key.WithKeys("enter"), key.WithHelp("enter", "install")),
+		}
+	}
 
 	// Setup model
-	m := model{list: l, spinner: s, actions: actions, firstFlagInstall: len(actions) > 1}
+	m := model{list: l, checked: checked, chosen: chosen, spinner: s, actions: actions, firstFlagInstall: len(actions) > 0}
 
 	// Run the program
-	if _, err := tea.NewProgram(m).Run(); err != nil {
+	program = tea.NewProgram(m)
+	final, err := program.Run()
+	if err != nil {
 		fmt.Println("Error running program:", err)
 		os.Exit(1)
 	}
+	if final.(model).err != nil || len(final.(model).failedPackages) > 0 {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// Take a target out of its local path: remove its block or link, or its copy if it hasn't been
+// edited since it was saved. Returns what happened, for showing to the user
+func uninstallTarget(t Target, home string, dryRun bool) (string, error) {
+	localPath := expandPath(t.LocalPath, home)
+	repoFile := Config.repoDir(home) + "/" + t.RepoPath
+
+	if t.strategy(strategySymlink, false) == strategyBlock {
+		content, err := os.ReadFile(localPath)
+		if err != nil {
+			return "", nil
+		}
+		if _, found := t.extractBlock(content); !found {
+			return "", nil
+		}
+		if !dryRun {
+			if _, err := unblockTarget(t, localPath, home); err != nil {
+				return "", err
+			}
+		}
+		return "removed block from " + t.LocalPath, nil
+	}
+
+	// Links, including folded directories
+	if p := targetLink(t, home); p != "" {
+		if !dryRun {
+			if err := removeLink(p, false); err != nil {
+				return "", err
+			}
+		}
+		return "removed link " + tildePath(p, home), nil
+	}
+
+	// Hard links and unedited copies
+	content, err := os.ReadFile(localPath)
+	if err != nil {
+		return "", nil
+	}
+	base, saved := readBase(localPath)
+	switch {
+	case sameFile(localPath, repoFile):
+	case saved && bytes.Equal(content, base):
+	case saved:
+		return "kept " + t.LocalPath + " (edited locally)", nil
+	default:
+		return "", nil
+	}
+	if !dryRun {
+		if err := os.Remove(localPath); err != nil {
+			return "", err
+		}
+		os.Remove(basePath(localPath))
+	}
+	return "removed " + t.LocalPath, nil
+}
+
+// Undo the temporary install in dir, going by its manifest
+func uninstallTmp(dir string, dryRun bool) error {
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); os.IsNotExist(err) {
+		return fmt.Errorf("no temporary install in %s", dir)
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	for _, a := range m.uninstallActions(dir) {
+		if !dryRun {
+			if err := a.execute(); err != nil && !a.ignoreErrors {
+				return err
+			}
+		}
+		fmt.Printf("%s %s\n", checkMark, a.msg)
+	}
+	return nil
+}
+
+// Cobra uninstall command — takes dotfiles back out of the home directory
+var uninstallCmd = &cobra.Command{
+	Use:   "uninstall [target...]",
+	Short: "Remove installed dotfiles",
+	Long: "Remove installed dotfiles: managed blocks are taken out of the files they're in, links " +
+		"are removed, and copies are deleted unless they've been edited since they were saved. " +
+		"Targets can be given by class (e.g. zsh), repo path or local path, and default to every target. " +
+		"With --tmp, the temporary install is undone instead, uninstalling only the packages it added.",
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun := flagPresent(cmd, "dry-run")
+		if flagPresent(cmd, "tmp") {
+			if len(args) > 0 {
+				log.Fatal("Temporary installs are uninstalled as a whole, so don't give targets with --tmp")
+			}
+			if err := uninstallTmp(tmpDir(), dryRun); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		targets, err := selectTargets(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		changed := false
+		for _, t := range targets {
+			result, err := uninstallTarget(t, home, dryRun)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if result != "" {
+				fmt.Printf("%s %s\n", checkMark, result)
+				changed = true
+			}
+		}
+		if !changed {
+			fmt.Println("Nothing to uninstall")
+		}
+	},
+}
+
+func init() {
+	uninstallCmd.Flags().BoolP("dry-run", "n", false, "Show what would be removed without changing anything")
+	uninstallCmd.Flags().BoolP("tmp", "", false, "Undo the temporary install in "+Config.TmpDir)
+	rootCmd.AddCommand(uninstallCmd)
+}
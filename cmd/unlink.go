@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// Find the symlink into the cloned repo that provides a target: its local path, or a folded
+// directory above it
+func targetLink(t Target, home string) string {
+	repoDir := Config.repoDir(home)
+	for p := expandPath(t.LocalPath, home); within(p, home) && p != home; p = filepath.Dir(p) {
+		if within(linkDest(p), repoDir) {
+			return p
+		}
+	}
+	return ""
+}
+
+// Cobra unlink command — removes the symlinks made by full installs
+var unlinkCmd = &cobra.Command{
+	Use:   "unlink [target...]",
+	Short: "Remove symlinks to dotfiles in the cloned repo",
+	Long: "Remove symlinks to dotfiles in the cloned repo. Targets can be given by class (e.g. vim), " +
+		"repo path or local path, and default to every link made by a full install. Removing a " +
+		"target in a folded directory removes the link to the whole directory.",
+	Run: func(cmd *cobra.Command, args []string) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		targets, err := selectTargets(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		restore := flagPresent(cmd, "restore")
+		dryRun := flagPresent(cmd, "dry-run")
+
+		// Links for the given targets, plus every link we've made if none were given
+		paths := map[string]bool{}
+		for _, t := range targets {
+			if p := targetLink(t, home); p != "" {
+				paths[p] = true
+			}
+		}
+		if len(args) == 0 {
+			for _, p := range managedLinks() {
+				paths[p] = true
+			}
+		}
+		var sorted []string
+		for p := range paths {
+			sorted = append(sorted, p)
+		}
+		sort.Strings(sorted)
+
+		removed := 0
+		for _, p := range sorted {
+			if linkDest(p) == "" {
+				// Already gone, so just forget about it
+				if !dryRun {
+					if err := recordLink(p, false); err != nil {
+						log.Fatal(err)
+					}
+				}
+				continue
+			}
+			if !dryRun {
+				if err := removeLink(p, restore); err != nil {
+					log.Fatal(err)
+				}
+			}
+			removed++
+			if restore {
+				fmt.Printf("%s %s %s, replaced with a copy\n", checkMark, tildePath(p, home), linkRemoved)
+			} else {
+				fmt.Printf("%s %s %s\n", checkMark, tildePath(p, home), linkRemoved)
+			}
+		}
+		if removed == 0 {
+			fmt.Println("No symlinks to remove")
+		}
+	},
+}
+
+func init() {
+	unlinkCmd.Flags().BoolP("restore", "r", false, "Replace each link with a copy of the file it points to")
+	unlinkCmd.Flags().BoolP("dry-run", "n", false, "Show what would be removed without changing anything")
+	rootCmd.AddCommand(unlinkCmd)
+}
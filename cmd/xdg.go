@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// XDG base directories targets can be placed in, with the environment variables that set them and
+// their defaults
+var xdgBaseDirs = map[string]struct{ env, fallback string }{
+	"config": {"XDG_CONFIG_HOME", "~/.config"},
+	"data":   {"XDG_DATA_HOME", "~/.local/share"},
+	"state":  {"XDG_STATE_HOME", "~/.local/state"},
+}
+
+// Get an XDG base directory, ignoring relative paths in the environment as the spec says to
+func xdgHome(kind string) string {
+	dir := xdgBaseDirs[kind]
+	if path := os.Getenv(dir.env); filepath.IsAbs(path) {
+		return path
+	}
+	return expandHome(dir.fallback)
+}
+
+// Versions of installed programs, looked up once each
+var programVersions = map[string]string{}
+
+// Find numbers like 3.1 or 2.43.0 in version output
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)*`)
+
+// Get the version of an installed program from its --version or -V output
+func programVersion(name string) (string, bool) {
+	if v, ok := programVersions[name]; ok {
+		return v, v != ""
+	}
+	programVersions[name] = ""
+	if !commandExists(name) {
+		return "", false
+	}
+	for _, flag := range []string{"--version", "-V"} {
+		output, err := exec.Command(name, flag).Output()
+		if err != nil {
+			continue
+		}
+		firstLine, _, _ := strings.Cut(string(output), "\n")
+		if v := versionPattern.FindString(firstLine); v != "" {
+			programVersions[name] = v
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Compare dotted version numbers, returning -1, 0 or 1
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Parse an xdg_requires requirement like "tmux >= 3.1"
+var requirementPattern = regexp.MustCompile(`^\s*(\S+)\s*>=\s*(\d+(?:\.\d+)*)\s*$`)
+
+func parseRequirement(s string) (string, string, error) {
+	m := requirementPattern.FindStringSubmatch(s)
+	if m == nil {
+		return "", "", fmt.Errorf("invalid requirement %q, should be like \"tmux >= 3.1\"", s)
+	}
+	return m[1], m[2], nil
+}
+
+// Get a target's XDG location (which base directory, and the path in it), if it has one
+func (t Target) xdgPath() (string, string, bool) {
+	for kind, path := range map[string]string{"config": t.XDGConfig, "data": t.XDGData, "state": t.XDGState} {
+		if path != "" {
+			return kind, path, true
+		}
+	}
+	return "", "", false
+}
+
+// Work out where a target goes on this machine. Targets with an XDG location go there, unless
+// xdg_requires names a program that's installed but too old to look there, in which case they go
+// to local_path. The path starts with ~ if it's in the home directory
+func (t Target) localPath() string {
+	if _, _, ok := t.xdgPath(); ok && t.XDGRequires != "" && t.LocalPath != "" {
+		program, minimum, err := parseRequirement(t.XDGRequires)
+		if err == nil {
+			if v, installed := programVersion(program); installed && compareVersions(v, minimum) < 0 {
+				return t.LocalPath
+			}
+		}
+	}
+	return t.preferredPath()
+}
+
+// Get where a target goes if nothing rules out its XDG location, without checking xdg_requires
+// (which runs the program it names)
+func (t Target) preferredPath() string {
+	kind, path, ok := t.xdgPath()
+	if !ok {
+		return t.LocalPath
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(xdgHome(kind), path)
+	}
+	return tildePath(filepath.Join(xdgHome(kind), path), home)
+}